@@ -0,0 +1,275 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api defines the types exchanged through the sith HTTP API, shared by
+// the server and the client.
+package api
+
+// Track is a single track, with a summary of its album and artists. Only the
+// URI is set unless the track is loaded.
+type Track struct {
+	URI        string          `json:"uri"`
+	Loaded     bool            `json:"loaded"`
+	Name       string          `json:"name"`
+	Duration   float64         `json:"duration"`
+	Popularity float64         `json:"popularity"`
+	Album      *SimpleAlbum    `json:"album"`
+	Artists    []*SimpleArtist `json:"artists"`
+}
+
+// SimpleAlbum is the summary of an album, as referenced from a track.
+type SimpleAlbum struct {
+	Id       string `json:"id"`
+	URI      string `json:"uri"`
+	Name     string `json:"name"`
+	HasImage bool   `json:"has_image"`
+}
+
+// Album is an album. The type, covers, copyrights, review and tracks are only
+// set when requesting a single album, and only the id and URI are set unless
+// the album is loaded.
+type Album struct {
+	Id         string        `json:"id"`
+	URI        string        `json:"uri"`
+	Loaded     bool          `json:"loaded"`
+	Name       string        `json:"name"`
+	Year       int           `json:"year"`
+	HasImage   bool          `json:"has_image"`
+	Artist     *SimpleArtist `json:"artist"`
+	Type       string        `json:"type,omitempty"`
+	Covers     []string      `json:"covers,omitempty"`
+	Copyrights []string      `json:"copyrights,omitempty"`
+	Review     string        `json:"review,omitempty"`
+	Tracks     []*AlbumTrack `json:"tracks,omitempty"`
+}
+
+// AlbumTrack is a track on an album, with its disc and its number on the disc.
+type AlbumTrack struct {
+	Disc  int    `json:"disc"`
+	Index int    `json:"index"`
+	Track *Track `json:"track"`
+}
+
+// SimpleArtist is the summary of an artist.
+type SimpleArtist struct {
+	URI  string `json:"uri"`
+	Name string `json:"name"`
+}
+
+// Artist is an artist as found when searching. Only the id and URI are set
+// unless the artist is loaded.
+type Artist struct {
+	Id       string `json:"id"`
+	URI      string `json:"uri"`
+	Loaded   bool   `json:"loaded"`
+	Name     string `json:"name"`
+	HasImage bool   `json:"has_image"`
+}
+
+// Playlist is a playlist. Items are only set when requesting a single
+// playlist, and only the id and URI are set unless the playlist is loaded.
+type Playlist struct {
+	Id            string           `json:"id"`
+	URI           string           `json:"uri"`
+	Loaded        bool             `json:"loaded"`
+	Name          string           `json:"name"`
+	Description   string           `json:"description"`
+	Collaborative bool             `json:"collaborative"`
+	Subscribers   int              `json:"subscribers"`
+	Owner         string           `json:"owner"`
+	HasImage      bool             `json:"has_image"`
+	Items         []*PlaylistTrack `json:"items"`
+}
+
+// PlaylistTrack is a track in a playlist, with who added it and when.
+type PlaylistTrack struct {
+	UID   string `json:"uid"`
+	User  string `json:"user"`
+	Time  string `json:"time"`
+	Track *Track `json:"track"`
+}
+
+// PlaylistResult is the response of a single playlist.
+type PlaylistResult struct {
+	Playlist *Playlist `json:"playlist"`
+}
+
+// AlbumResult is the response of a single album.
+type AlbumResult struct {
+	Album *Album `json:"album"`
+}
+
+// PlaylistsResult is the response listing the playlists of the user.
+type PlaylistsResult struct {
+	Playlists []*Playlist `json:"playlists"`
+}
+
+// SearchResult is the response of a search. Only the types searched for are
+// set.
+type SearchResult struct {
+	URI        string `json:"uri"`
+	DidYouMean string `json:"didyoumean"`
+
+	Artists   []*Artist   `json:"artists"`
+	Albums    []*Album    `json:"albums"`
+	Tracks    []*Track    `json:"tracks"`
+	Playlists []*Playlist `json:"playlists"`
+
+	Totals SearchTotals `json:"totals"`
+}
+
+// SearchTotals are the total number of matches of each type, to page through.
+type SearchTotals struct {
+	Artists   int `json:"artists"`
+	Albums    int `json:"albums"`
+	Tracks    int `json:"tracks"`
+	Playlists int `json:"playlists"`
+}
+
+// Suggestion is a search suggestion. Artist is set for albums and tracks.
+type Suggestion struct {
+	URI    string `json:"uri"`
+	Name   string `json:"name"`
+	Artist string `json:"artist,omitempty"`
+}
+
+// SuggestResult is the response of search suggestions, with the top matches
+// of each type for the query.
+type SuggestResult struct {
+	Query string `json:"query"`
+
+	Artists   []*Suggestion `json:"artists"`
+	Albums    []*Suggestion `json:"albums"`
+	Tracks    []*Suggestion `json:"tracks"`
+	Playlists []*Suggestion `json:"playlists"`
+}
+
+// HistoryEntry is a search made by the user. Time is in RFC 3339 format.
+type HistoryEntry struct {
+	Query string `json:"query"`
+	URI   string `json:"uri"`
+	Time  string `json:"time"`
+}
+
+// HistoryResult lists the latest searches of the user, latest first.
+type HistoryResult struct {
+	History []*HistoryEntry `json:"history"`
+}
+
+// SavedSearch is a search saved by the user under a name. The URI can be
+// loaded as a play context.
+type SavedSearch struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	URI   string `json:"uri"`
+	Time  string `json:"time"`
+}
+
+// SavedSearchesResult lists the saved searches of the user.
+type SavedSearchesResult struct {
+	Saved []*SavedSearch `json:"saved"`
+}
+
+// VolumeResult is the current volume in percent.
+type VolumeResult struct {
+	Volume int `json:"volume"`
+}
+
+// StatusResult is the state of the player.
+type StatusResult struct {
+	LoggedIn bool   `json:"logged_in"`
+	Playing  bool   `json:"playing"`
+	UID      string `json:"uid,omitempty"`
+	Track    *Track `json:"track"`
+	Volume   int    `json:"volume"`
+}
+
+// QueueResult lists the tracks queued to play after the current one.
+type QueueResult struct {
+	Tracks []*Track `json:"tracks"`
+}
+
+// LogEntry is a log message kept in the log history.
+type LogEntry struct {
+	ID      uint64 `json:"id"`
+	Time    int64  `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module"`
+	Message string `json:"message"`
+}
+
+// LogResult is the response listing the log history, oldest first.
+type LogResult struct {
+	Entries []*LogEntry `json:"entries"`
+}
+
+// HealthResult is the outcome of a health or readiness check. Checks maps each
+// check to "ok" or the reason it failed.
+type HealthResult struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// ReloadResult describes the outcome of a reload.
+type ReloadResult struct {
+	Applied []string `json:"applied"`
+	Restart []string `json:"restart"`
+}
+
+// Error is returned by the API for expected and handled errors.
+type Error struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Param       string `json:"param"`
+}
+
+func (e *Error) Error() string {
+	return e.Description
+}
+
+// ErrorResult wraps the error in responses.
+type ErrorResult struct {
+	Error *Error `json:"error"`
+}
+
+// LoadRequest starts playing the track at the index of the context.
+type LoadRequest struct {
+	Context string `json:"ctx"`
+	Index   int    `json:"index"`
+	URI     string `json:"uri,omitempty"`
+	Query   string `json:"query,omitempty"`
+}
+
+// QueueRequest queues a track to play after the current one.
+type QueueRequest struct {
+	URI string `json:"uri"`
+}
+
+// SaveSearchRequest saves a search under a name, replacing any search saved
+// with the same name.
+type SaveSearchRequest struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// SeekRequest moves the playback position, in seconds.
+type SeekRequest struct {
+	Position float64 `json:"position"`
+}
+
+// VolumeRequest sets the volume in percent.
+type VolumeRequest struct {
+	Volume int `json:"volume"`
+}
@@ -0,0 +1,418 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is a typed client for the sith HTTP API, as described by the
+// OpenAPI document served at /api/openapi.json.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/op/sith/api"
+)
+
+// apiPath is the path of the API version used, relative to the base URL.
+const apiPath = "api/v1/"
+
+// Client talks to a running sith instance.
+type Client struct {
+	// BaseURL is the address of the instance, eg. http://localhost:8107/.
+	BaseURL *url.URL
+
+	// Token is passed as a bearer token, if set.
+	Token string
+
+	// HTTPClient is used to make the requests.
+	HTTPClient *http.Client
+}
+
+// New creates a new client for the instance at baseURL.
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &Client{BaseURL: u, HTTPClient: http.DefaultClient}, nil
+}
+
+// Page selects the page and the number of items per page. Zero values use the
+// server defaults.
+type Page struct {
+	Page  int
+	Limit int
+}
+
+func (p *Page) values() url.Values {
+	v := url.Values{}
+	if p != nil && p.Page > 0 {
+		v.Set("page", strconv.Itoa(p.Page))
+	}
+	if p != nil && p.Limit > 0 {
+		v.Set("limit", strconv.Itoa(p.Limit))
+	}
+	return v
+}
+
+// Range selects items by offset and limit. Zero values use the page.
+type Range struct {
+	Offset int
+	Limit  int
+}
+
+// SearchOptions selects what to search for.
+type SearchOptions struct {
+	// Types are the types to search for: artist, album, track or playlist.
+	// All types are searched for when empty.
+	Types []string
+
+	// Page applies to all types, unless a range is given for the type.
+	Page *Page
+
+	Artists, Albums, Tracks, Playlists *Range
+}
+
+func (o *SearchOptions) values() url.Values {
+	if o == nil {
+		return url.Values{}
+	}
+	v := o.Page.values()
+	if len(o.Types) > 0 {
+		v.Set("type", strings.Join(o.Types, ","))
+	}
+	for name, r := range map[string]*Range{
+		"artist":   o.Artists,
+		"album":    o.Albums,
+		"track":    o.Tracks,
+		"playlist": o.Playlists,
+	} {
+		if r != nil && r.Offset > 0 {
+			v.Set(name+"_offset", strconv.Itoa(r.Offset))
+		}
+		if r != nil && r.Limit > 0 {
+			v.Set(name+"_limit", strconv.Itoa(r.Limit))
+		}
+	}
+	return v
+}
+
+// Search queries the Spotify catalogue for all types.
+func (c *Client) Search(query string, page *Page) (*api.SearchResult, error) {
+	return c.SearchWith(query, &SearchOptions{Page: page})
+}
+
+// SearchWith queries the Spotify catalogue as selected by opts.
+func (c *Client) SearchWith(query string, opts *SearchOptions) (*api.SearchResult, error) {
+	v := opts.values()
+	v.Set("query", query)
+	var r api.SearchResult
+	return &r, c.do("GET", "search", v, nil, &r)
+}
+
+// SearchHistory lists the latest searches, latest first.
+func (c *Client) SearchHistory() ([]*api.HistoryEntry, error) {
+	var r api.HistoryResult
+	err := c.do("GET", "search/history", nil, nil, &r)
+	return r.History, err
+}
+
+// ClearSearchHistory forgets the latest searches.
+func (c *Client) ClearSearchHistory() error {
+	return c.do("DELETE", "search/history", nil, nil, nil)
+}
+
+// SavedSearches lists the saved searches.
+func (c *Client) SavedSearches() ([]*api.SavedSearch, error) {
+	var r api.SavedSearchesResult
+	err := c.do("GET", "search/saved", nil, nil, &r)
+	return r.Saved, err
+}
+
+// SaveSearch saves the query under the name, replacing any search saved with
+// the same name.
+func (c *Client) SaveSearch(name, query string) (*api.SavedSearch, error) {
+	var r api.SavedSearch
+	return &r, c.do("POST", "search/saved", nil, &api.SaveSearchRequest{Name: name, Query: query}, &r)
+}
+
+// DeleteSavedSearch deletes the saved search with the id.
+func (c *Client) DeleteSavedSearch(id string) error {
+	return c.do("DELETE", "search/saved/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// Playlists lists the playlists of the logged in user.
+func (c *Client) Playlists(page *Page) (*api.PlaylistsResult, error) {
+	var r api.PlaylistsResult
+	return &r, c.do("GET", "playlists", page.values(), nil, &r)
+}
+
+// Playlist returns the playlist, including its tracks.
+func (c *Client) Playlist(username, id string, page *Page) (*api.PlaylistResult, error) {
+	var r api.PlaylistResult
+	path := "user/" + url.PathEscape(username) + "/playlist/" + url.PathEscape(id)
+	return &r, c.do("GET", path, page.values(), nil, &r)
+}
+
+// Album returns the album, including its tracks.
+func (c *Client) Album(id string) (*api.AlbumResult, error) {
+	var r api.AlbumResult
+	return &r, c.do("GET", "album/"+url.PathEscape(id), nil, nil, &r)
+}
+
+// Image returns the image of an album or artist, identified by the entity type
+// and its id.
+func (c *Client) Image(entity, id string) ([]byte, error) {
+	return c.raw("image/" + url.PathEscape(entity) + "/" + url.PathEscape(id))
+}
+
+// PlaylistImage returns the image of a playlist.
+func (c *Client) PlaylistImage(username, id string) ([]byte, error) {
+	return c.raw("image/user/" + url.PathEscape(username) + "/playlist/" + url.PathEscape(id))
+}
+
+// Status returns the state of the player.
+func (c *Client) Status() (*api.StatusResult, error) {
+	var r api.StatusResult
+	return &r, c.do("GET", "player/status", nil, nil, &r)
+}
+
+// Play resumes playback.
+func (c *Client) Play() error {
+	return c.do("POST", "player/play", nil, nil, nil)
+}
+
+// Pause pauses playback.
+func (c *Client) Pause() error {
+	return c.do("POST", "player/pause", nil, nil, nil)
+}
+
+// Next skips to the next track.
+func (c *Client) Next() error {
+	return c.do("POST", "player/next", nil, nil, nil)
+}
+
+// Load starts playing a track in a playlist or search context.
+func (c *Client) Load(req *api.LoadRequest) error {
+	return c.do("POST", "player/load", nil, req, nil)
+}
+
+// Queue queues a track to play after the current one.
+func (c *Client) Queue(uri string) error {
+	return c.do("POST", "player/queue", nil, &api.QueueRequest{URI: uri}, nil)
+}
+
+// Queued lists the tracks queued to play after the current one.
+func (c *Client) Queued() ([]*api.Track, error) {
+	var r api.QueueResult
+	err := c.do("GET", "player/queue", nil, nil, &r)
+	return r.Tracks, err
+}
+
+// Seek moves the playback position to the given number of seconds.
+func (c *Client) Seek(position float64) error {
+	return c.do("POST", "player/seek", nil, &api.SeekRequest{Position: position}, nil)
+}
+
+// Volume returns the volume in percent.
+func (c *Client) Volume() (int, error) {
+	var r api.VolumeResult
+	err := c.do("GET", "player/volume", nil, nil, &r)
+	return r.Volume, err
+}
+
+// SetVolume sets the volume in percent and returns the volume in effect.
+func (c *Client) SetVolume(volume int) (int, error) {
+	var r api.VolumeResult
+	err := c.do("PUT", "player/volume", nil, &api.VolumeRequest{Volume: volume}, &r)
+	return r.Volume, err
+}
+
+// Reload makes the instance reload its configuration.
+func (c *Client) Reload() (*api.ReloadResult, error) {
+	var r api.ReloadResult
+	return &r, c.do("POST", "admin/reload", nil, nil, &r)
+}
+
+// Events opens the stream of server sent events, optionally filtered by the
+// query. The caller must close the returned stream.
+func (c *Client) Events(query url.Values) (*EventStream, error) {
+	req, err := c.newRequest("GET", "events", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return newEventStream(resp.Body), nil
+}
+
+func (c *Client) newRequest(method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	u, err := c.BaseURL.Parse(apiPath + path)
+	if err != nil {
+		return nil, err
+	}
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// do makes the request and decodes any JSON response into v.
+func (c *Client) do(method, path string, query url.Values, body, v interface{}) error {
+	req, err := c.newRequest(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// raw makes a GET request and returns the body as is.
+func (c *Client) raw(path string) ([]byte, error) {
+	req, err := c.newRequest("GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// checkResponse returns the API error for unsuccessful responses.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	var r api.ErrorResult
+	if err := json.NewDecoder(resp.Body).Decode(&r); err == nil && r.Error != nil {
+		return r.Error
+	}
+	return fmt.Errorf("unexpected status: %s", resp.Status)
+}
+
+// Event is a server sent event. Data is the JSON payload, as described by the
+// event catalogue.
+type Event struct {
+	ID    string
+	Event string
+	Data  json.RawMessage
+}
+
+// EventStream reads events from the server.
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+func newEventStream(body io.ReadCloser) *EventStream {
+	return &EventStream{body: body, scanner: bufio.NewScanner(body)}
+}
+
+// Next blocks until the next event is received. io.EOF is returned when the
+// stream ends.
+func (s *EventStream) Next() (*Event, error) {
+	var e Event
+	var data []string
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if line == "" {
+			if e.Event == "" && len(data) == 0 {
+				continue
+			}
+			if e.Event == "" {
+				e.Event = "message"
+			}
+			e.Data = json.RawMessage(strings.Join(data, "\n"))
+			return &e, nil
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i == 0 {
+			// Comment, used for keep alive
+			continue
+		} else if i > 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			e.ID = value
+		case "event":
+			e.Event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close closes the stream.
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
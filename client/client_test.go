@@ -0,0 +1,108 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/op/sith/api"
+)
+
+func TestEventStream(t *testing.T) {
+	var tests = []struct {
+		stream string
+		events []Event
+	}{
+		{"", nil},
+		{": ping\n\n", nil},
+		{"retry: 3000\n\n", nil},
+		{"id: 1\nevent: track-end\ndata: {}\n\n", []Event{{"1", "track-end", []byte("{}")}}},
+		{"id:2\nevent:state\ndata:{}\n\n", []Event{{"2", "state", []byte("{}")}}},
+		{"data: [1,\ndata: 2]\n\n", []Event{{"", "message", []byte("[1,\n2]")}}},
+		{"event: a\ndata: 1\n\n: ping\n\nevent: b\ndata: 2\n\n", []Event{
+			{"", "a", []byte("1")},
+			{"", "b", []byte("2")},
+		}},
+		// An event which is not terminated is never dispatched.
+		{"event: a\ndata: 1\n", nil},
+	}
+	for _, test := range tests {
+		s := newEventStream(ioutil.NopCloser(strings.NewReader(test.stream)))
+		var events []Event
+		for {
+			e, err := s.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, *e)
+		}
+		if !reflect.DeepEqual(events, test.events) {
+			t.Errorf("%q: %v != %v", test.stream, events, test.events)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/events" || r.URL.Query().Get("types") != "play-track" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error": {"code": "access_error", "description": "denied"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "retry: 3000\n\nid: 5\nevent: play-track\ndata: {\"uid\":\"u\"}\n\n")
+	}))
+	defer server.Close()
+
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"types": {"play-track"}}
+	if _, err := c.Events(query); err == nil {
+		t.Fatal("expected error without token")
+	} else if e, ok := err.(*api.Error); !ok || e.Code != "access_error" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+
+	c.Token = "secret"
+	s, err := c.Events(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "5" || e.Event != "play-track" || string(e.Data) != `{"uid":"u"}` {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("expected end of stream: %v", err)
+	}
+}
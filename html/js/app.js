@@ -1,34 +1,17 @@
-// Server sent events to subscribe to and propagate to angular
-serverEvents = [
-  'connection-error',
-  'connection-state',
-  'event-test',
-  'log',
-  'logged-in',
-  'logged-out',
-  'play-token-lost',
-  'play-track',
-  'play-track-failed',
-  'streaming-error',
-  'track-end',
-  'track-end',
-  'user-message',
-];
-
 angular.module('sith', [
 	'ui.router',
 	'sith.controllers'
 ])
 
 .run(
-	function($rootScope, $state, $stateParams) {
+	function($rootScope, $state, $stateParams, $http) {
 		$rootScope.$state = $state;
 		$rootScope.$stateParams = $stateParams;
 
     // User messages from acccess point
     $rootScope.messages = [];
     $rootScope.$on('user-message', function(event, message) {
-      $rootScope.messages.push(message);
+      $rootScope.messages.push(message.message);
     });
 
     // Push all server sent events through the root scope
@@ -39,10 +22,48 @@ angular.module('sith', [
         $rootScope.$broadcast(message.type, data);
       });
     };
-    var events = new EventSource('/events');
-    for (i in serverEvents) {
-      events.addEventListener(serverEvents[i], propagateServerEvent);
-    }
+    // Subscribe to all events listed in the event catalogue. The stream is
+    // opened again after logging in, since it cannot recover from a 401.
+    var events = null;
+    var subscribe = function() {
+      $http.get('/api/v1/events/schema').success(function(schema) {
+        if (events) {
+          events.close();
+        }
+        events = new EventSource('/api/v1/events');
+        angular.forEach(schema.events, function(event) {
+          events.addEventListener(event.name, propagateServerEvent);
+        });
+      });
+    };
+    subscribe();
+    $rootScope.$on('logged-in', subscribe);
+
+    $rootScope.logout = function() {
+      $http.post('/api/v1/auth/logout').success(function() {
+        if (events) {
+          events.close();
+          events = null;
+        }
+        $state.go('login');
+      });
+    };
+})
+
+.config(
+  function($httpProvider) {
+    // Ask for the access token whenever the API requires one.
+    $httpProvider.interceptors.push(function($q, $injector) {
+      return {
+        responseError: function(rejection) {
+          var $state = $injector.get('$state');
+          if (rejection.status == 401 && !$state.is('login')) {
+            $state.go('login');
+          }
+          return $q.reject(rejection);
+        }
+      };
+    });
 })
 
 .config(
@@ -59,6 +80,15 @@ angular.module('sith', [
           }
         }
       })
+      .state('login', {
+        url: "/login",
+        views: {
+          "main": {
+            controller: 'sith.ctrl.login',
+            templateUrl: "tmpl/login.html"
+          }
+        }
+      })
       .state('log', {
         url: "/log",
         views: {
@@ -95,6 +125,18 @@ angular.module('sith', [
           }
         }
       })
+      .state('album', {
+        url: "/album/{albumId:[^/]+}",
+        views: {
+          "main": {
+            controller: 'sith.ctrl.album',
+            templateUrl: "tmpl/album.html"
+          },
+          "navigation": {
+            templateUrl: "tmpl/index.navigation.html"
+          }
+        }
+      })
       .state('playlist', {
         url: "/user/{username:[^/]+}/playlist/{playlistId:[^/]+}",
         views: {
@@ -109,24 +151,33 @@ angular.module('sith', [
       })
 })
 
-.service('LogService', function($rootScope) {
-  var logs = [];
-
-  $rootScope.on('log', function(evt, log) {
-    console.log('LOG', log);
-    logs.push(log);
-  });
+.controller('LogController', function($scope, $http, $interval) {
+  // Poll the log history for entries newer than the ones shown.
+  var limit = 500;
+  $scope.logs = [];
+  $scope.level = 'info';
+  $scope.levels = ['critical', 'error', 'warning', 'notice', 'info', 'debug'];
 
-  this.all = function() {
-    return logs;
+  var since = 0;
+  var refresh = function() {
+    var params = {since: since, level: $scope.level};
+    $http.get('/api/v1/log', {params: params}).success(function(data) {
+      angular.forEach(data.entries, function(entry) {
+        $scope.logs.unshift(entry);
+        since = entry.id;
+      });
+      $scope.logs.splice(limit);
+    });
   };
-})
 
-.controller('LogController', function($scope) {
-  // $scope.logs = log.logs;
+  $scope.$watch('level', function() {
+    since = 0;
+    $scope.logs = [];
+    refresh();
+  });
 
-  $scope.$on('log', function(evt, log) {
-    console.log('eehr', log);
-    // $scope.logs.push(log);
+  var timer = $interval(refresh, 2000);
+  $scope.$on('$destroy', function() {
+    $interval.cancel(timer);
   });
 });
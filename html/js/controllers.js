@@ -47,6 +47,21 @@ ctrls.controller('sith.ctrl.player', function($scope, $http, $interval) {
     $scope.playing = true;
   });
 
+  // state is sent on (re)connect when the events in between are unknown.
+  $scope.$on('state', function(event, state) {
+    if (state.track) {
+      $scope.current = state.track;
+    }
+    $scope.playing = state.playing;
+  });
+
+  // player-state is sent when paused or resumed, from here or elsewhere.
+  $scope.$on('player-state', function(event, state) {
+    $scope.playing = state.playing;
+    $scope.offset = state.position;
+    updateProgress();
+  });
+
   $scope.$on('play-track-failed', function() {
     $.snackbar({
       content: "Failed to play track.",
@@ -59,68 +74,163 @@ ctrls.controller('sith.ctrl.player', function($scope, $http, $interval) {
     if (playTokenSnackbar) {
       playTokenSnackbar.snackbar("hide");
     }
-    $http.get('/player/play?oauth_token=xxx');
+    $http.post('/api/v1/player/play');
     $scope.playing = true;
   };
   $scope.pause = function() {
-    $http.get('/player/pause?oauth_token=xxx');
+    $http.post('/api/v1/player/pause');
     $scope.playing = false;
   };
 });
 
 ctrls.controller('sith.ctrl.search', function ($scope, $state, $http) {
-  $scope.$on('search', function(event, query) {
+  var limit = 10;
+  var search = function(query, params) {
+    params = angular.extend({query: query, limit: limit}, params);
     // TODO move all http calls into separate module
-    $http.get('/search?query=' + query + '&oauth_token=xxx').success(function(data) {
+    return $http.get('/api/v1/search', {params: params});
+  };
+
+  var refresh = function() {
+    $http.get('/api/v1/search/history').success(function(data) {
+      $scope.history = data.history;
+    });
+    $http.get('/api/v1/search/saved').success(function(data) {
+      $scope.saved = data.saved;
+    });
+  };
+  refresh();
+
+  $scope.run = function(query) {
+    search(query).success(function(data) {
       $scope.search = data;
       $scope.query = query;
     });
+  };
+  $scope.$on('search', function(event, query) {
+    $scope.run(query);
   });
+
+  $scope.save = function() {
+    var name = prompt('Save search as', $scope.query);
+    if (name) {
+      $http.post('/api/v1/search/saved', {name: name, query: $scope.query}).success(refresh);
+    }
+  };
+  $scope.unsave = function(saved) {
+    $http.delete('/api/v1/search/saved/' + saved.id).success(refresh);
+  };
+  $scope.playSaved = function(saved) {
+    $http.post('/api/v1/player/load', {ctx: saved.uri, index: 0});
+  };
+  $scope.clearHistory = function() {
+    $http.delete('/api/v1/search/history').success(refresh);
+  };
+
+  // more fetches the next page of one type, eg. more tracks, keeping the rest.
+  $scope.more = function(type, items) {
+    var params = {type: type};
+    params[type + '_offset'] = $scope.search[items].length;
+    search($scope.query, params).success(function(data) {
+      $scope.search[items] = $scope.search[items].concat(data[items]);
+    });
+  };
+
   $scope.load = function(context, index, uri) {
-    // TODO url encode parameters
     // HACK the query parameter is already found in the uri
     console.log('loading search result', context, index, uri, $scope.query);
-    $http.get('/player/load?ctx=' + context + '&index=' + index + '&uri=' + uri + '&query=' + $scope.query + '&oauth_token=xxx').success(function() {
+    var args = {ctx: context, index: index, uri: uri, query: $scope.query};
+    $http.post('/api/v1/player/load', args).success(function() {
       console.log('Successfully changed track to: %s', uri);
     });
   };
 });
 
-ctrls.controller('sith.ctrl.search2', function($scope, $rootScope) {
+ctrls.controller('sith.ctrl.search2', function($scope, $rootScope, $http) {
+  // client identifies this page to the server, to only supersede its own
+  // suggestions.
+  var client = Math.random().toString(36).slice(2);
+
   // TODO is there a better way to pass data to main controller?
   $scope.execute = function() {
+    $scope.suggestions = null;
     // TODO ng-minlength should take care of this?
-    if (this.query) {
-      $rootScope.$broadcast('search', this.query);
+    if ($scope.query) {
+      $rootScope.$broadcast('search', $scope.query);
     }
   };
+
+  // suggest shows the top matches while typing. The server waits for typing
+  // to pause and answers superseded queries with a 409, which are ignored.
+  $scope.suggest = function() {
+    if (!$scope.query) {
+      $scope.suggestions = null;
+      return;
+    }
+    $http.get('/api/v1/search/suggest', {params: {query: $scope.query, client: client}}).success(function(data) {
+      if (data.query === $scope.query) {
+        $scope.suggestions = data;
+      }
+    });
+  };
+
+  $scope.pick = function(suggestion) {
+    $scope.query = suggestion.name;
+    $scope.execute();
+  };
 });
 
 ctrls.controller('sith.ctrl.playlists', ['$scope', '$http', function($scope, $http) {
-  $http.get('/playlists?limit=6789').success(function(data) {
+  $http.get('/api/v1/playlists?limit=6789').success(function(data) {
     $scope.playlists = data.playlists;
   });
 }]);
 
 ctrls.controller('sith.ctrl.playlist', ['$scope', '$http', '$state', function($scope, $http, $state) {
   // TODO url escape?
-  var url = '/user/' + $state.params.user + '/playlist/' + $state.params.playlistId;
+  var url = '/api/v1/user/' + $state.params.username + '/playlist/' + $state.params.playlistId;
   $http.get(url + '?limit=6789').success(function(data) {
     $scope.playlist = data.playlist;
   });
 
   $scope.load = function(context, index, uri) {
     console.log('loading playlist result', context, index, uri);
-    $http.get('/player/load?ctx=' + context + '&index=' + index + '&uri=' + uri + '&oauth_token=xxx').success(function() {
+    var args = {ctx: context, index: index, uri: uri};
+    $http.post('/api/v1/player/load', args).success(function() {
       console.log('Successfully changed track to: %s', uri);
     });
   };
 }]);
 
-// ctrls.controller('LogController', ['$scope', 'LogService', function($scope, LogService) {
-//   // $scope.logs = log.logs;
-//
-//   $scope.$on('log', function(evt, log) {
-//     // $scope.logs.push(log);
-//   });
-// }]);
+ctrls.controller('sith.ctrl.album', ['$scope', '$http', '$state', function($scope, $http, $state) {
+  $http.get('/api/v1/album/' + encodeURIComponent($state.params.albumId)).success(function(data) {
+    $scope.album = data.album;
+    // Show the largest cover available.
+    $scope.cover = data.album.covers[data.album.covers.length - 1];
+    $scope.discs = {};
+    angular.forEach(data.album.tracks, function(item) {
+      $scope.discs[item.disc] = true;
+    });
+  });
+
+  $scope.multidisc = function() {
+    return Object.keys($scope.discs || {}).length > 1;
+  };
+
+  $scope.load = function(context, index, uri) {
+    $http.post('/api/v1/player/load', {ctx: context, index: index, uri: uri});
+  };
+}]);
+
+ctrls.controller('sith.ctrl.login', ['$scope', '$rootScope', '$http', '$state', function($scope, $rootScope, $http, $state) {
+  $scope.token = '';
+  $scope.login = function() {
+    $scope.error = null;
+    $http.post('/api/v1/auth/login', {token: $scope.token}).success(function() {
+      $rootScope.$broadcast('logged-in');
+      $state.go('index');
+    }).error(function(data) {
+      $scope.error = data && data.error ? data.error.description : 'login failed';
+    });
+  };
+}]);
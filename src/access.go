@@ -0,0 +1,110 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/op/go-logging"
+)
+
+// requestIDHeader carries the id of the request, both in the response and
+// optionally from a proxy in front.
+const requestIDHeader = "X-Request-Id"
+
+// accessLog is the log of handled requests, as the module sith.access.
+var accessLog = logging.MustGetLogger(prog + ".access")
+
+// requestInfo describes the request being handled, for the access log and to
+// trace the events caused by it.
+type requestInfo struct {
+	ID string
+
+	// route is the id of the API route, if any, and identity who the
+	// request was authenticated as.
+	route    string
+	identity string
+}
+
+// requestID returns the id passed by a proxy in front, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	return randomID()
+}
+
+// randomID returns a random id of 16 hex characters.
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// tokenIdentity identifies a token in the log without revealing it.
+func tokenIdentity(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
+// accessHandler assigns each request an id, returned in the X-Request-Id
+// header, and logs the request once handled. API requests are logged at the
+// info level and anything else, eg. the web interface, at the debug level.
+func accessHandler(c martini.Context, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	info := &requestInfo{ID: requestID(r), route: "-", identity: "-"}
+	w.Header().Set(requestIDHeader, info.ID)
+	c.Map(info)
+	c.Next()
+
+	status := http.StatusOK
+	if rw, ok := w.(martini.ResponseWriter); ok && rw.Status() != 0 {
+		status = rw.Status()
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	format := "%s %s %d %s route=%s client=%s auth=%s id=%s"
+	args := []interface{}{r.Method, r.URL.Path, status, time.Since(start), info.route, client, info.identity, info.ID}
+	if info.route != "-" {
+		accessLog.Info(format, args...)
+	} else {
+		accessLog.Debug(format, args...)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	var tests = []struct {
+		id    string
+		valid bool
+	}{
+		{"5c1f2a7e9b3d4410", true},
+		{"req-1_2.3", true},
+		{"ABC", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{"a b", false},
+		{"a/b", false},
+		{"a\nb", false},
+		{"åäö", false},
+	}
+	for _, test := range tests {
+		if valid := validRequestID(test.id); valid != test.valid {
+			t.Errorf("%q: %v != %v", test.id, valid, test.valid)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(requestIDHeader, "from-proxy")
+	if id := requestID(r); id != "from-proxy" {
+		t.Errorf("expected the proxy id: %q", id)
+	}
+
+	r.Header.Set(requestIDHeader, "not valid")
+	id := requestID(r)
+	if len(id) != 16 || !validRequestID(id) {
+		t.Errorf("expected a new id: %q", id)
+	}
+}
+
+func TestWSRequestID(t *testing.T) {
+	var tests = []struct {
+		id   string
+		want string
+	}{
+		{"1", "1"},
+		{"cmd-42", "cmd-42"},
+		{"", "upgrade"},
+		{"not valid", "upgrade"},
+	}
+	for _, test := range tests {
+		if id := wsRequestID(&wsRequest{ID: test.id}, "upgrade"); id != test.want {
+			t.Errorf("%q: %q != %q", test.id, id, test.want)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codegangsta/martini"
@@ -26,39 +27,137 @@ import (
 	"github.com/martini-contrib/encoder"
 	"github.com/op/go-libspotify/spotify"
 	"github.com/op/go-logging"
+	"github.com/op/sith/api"
+)
+
+// The response types are shared with API clients through the api package.
+type (
+	Track               = api.Track
+	SimpleAlbum         = api.SimpleAlbum
+	Album               = api.Album
+	AlbumTrack          = api.AlbumTrack
+	AlbumResult         = api.AlbumResult
+	SimpleArtist        = api.SimpleArtist
+	Artist              = api.Artist
+	Playlist            = api.Playlist
+	PlaylistTrack       = api.PlaylistTrack
+	PlaylistResult      = api.PlaylistResult
+	PlaylistsResult     = api.PlaylistsResult
+	SearchResult        = api.SearchResult
+	SearchTotals        = api.SearchTotals
+	Suggestion          = api.Suggestion
+	SuggestResult       = api.SuggestResult
+	HistoryEntry        = api.HistoryEntry
+	HistoryResult       = api.HistoryResult
+	SavedSearch         = api.SavedSearch
+	SavedSearchesResult = api.SavedSearchesResult
+	VolumeResult        = api.VolumeResult
+	StatusResult        = api.StatusResult
+	QueueResult         = api.QueueResult
+	ReloadResult        = api.ReloadResult
+	HealthResult        = api.HealthResult
+	LogEntry            = api.LogEntry
+	LogResult           = api.LogResult
 )
 
 type bridge struct {
+	cfg    *config
 	sess   *spotify.Session
-	player player
+	player *player
 
-	ew EventsWriter
+	ew       *EventsWriter
+	searches *searchCache
 
-	mu      sync.RWMutex
-	cond    *sync.Cond
-	running bool
-	exit    chan struct{}
+	mu          sync.RWMutex
+	cond        *sync.Cond
+	running     bool
+	syncTimeout time.Duration
+	exit        chan struct{}
+
+	// processed is when the session events were last processed, in unix
+	// nanoseconds.
+	processed int64
 }
 
-func newBridge(session *spotify.Session, ew EventsWriter) *bridge {
+func newBridge(cfg *config, session *spotify.Session, ew *EventsWriter) *bridge {
 	b := &bridge{
-		sess:   session,
-		player: newPlayer(session, ew),
-		ew:     ew,
+		cfg:      cfg,
+		sess:     session,
+		player:   newPlayer(session, ew),
+		ew:       ew,
+		searches: newSearchCache(time.Duration(cfg.SearchCacheTTL) * time.Second),
+
+		syncTimeout: time.Duration(cfg.SyncTimeout) * time.Second,
+		exit:        make(chan struct{}, 1),
 	}
 	b.cond = sync.NewCond(b.mu.RLocker())
+	ew.SetSnapshot(b.snapshot)
 	go b.processEvents()
 	return b
 }
 
+// snapshot describes the current state of the session and player.
+func (b *bridge) snapshot() *StateSnapshot {
+	b.mu.RLock()
+	running := b.running
+	b.mu.RUnlock()
+
+	current, playing := b.player.Current()
+	s := &StateSnapshot{LoggedIn: running, Playing: playing, UID: current.UID}
+	if current.Track != nil {
+		s.Track = newTrack(current.Track)
+	}
+	return s
+}
+
 // sync tries to synchronize any call to first make sure we have a working
-// session object to the Spotify backend.
-func (b *bridge) sync() {
+// session object to the Spotify backend. If the session is not available
+// within the sync timeout, an error is returned.
+func (b *bridge) sync() *apiError {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
+	if b.running {
+		return nil
+	}
+
+	var deadline time.Time
+	if b.syncTimeout > 0 {
+		deadline = time.Now().Add(b.syncTimeout)
+		timer := time.AfterFunc(b.syncTimeout, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.cond.Broadcast()
+		})
+		defer timer.Stop()
+	}
 	for !b.running {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return newUnavailableError("spotify session not available")
+		}
 		b.cond.Wait()
 	}
+	return nil
+}
+
+// SetSyncTimeout sets how long to wait for the session to become available.
+// Zero waits forever.
+func (b *bridge) SetSyncTimeout(timeout time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncTimeout = timeout
+}
+
+// Responsive reports if the session events have been processed within the
+// duration, which they are at least every 200ms unless stuck.
+func (b *bridge) Responsive(d time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&b.processed))) < d
+}
+
+// Running reports if the session is logged in and available.
+func (b *bridge) Running() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.running
 }
 
 // freeze marks the session as not beeing available for the moment.
@@ -86,6 +185,15 @@ func (b *bridge) Stop() {
 	b.exit <- struct{}{}
 }
 
+// connectionStates names the connection states in events.
+var connectionStates = map[spotify.ConnectionState]string{
+	spotify.ConnectionStateLoggedOut:    "logged-out",
+	spotify.ConnectionStateLoggedIn:     "logged-in",
+	spotify.ConnectionStateDisconnected: "disconnected",
+	spotify.ConnectionStateUndefined:    "undefined",
+	spotify.ConnectionStateOffline:      "offline",
+}
+
 func (b *bridge) processEvents() {
 	var stopping bool
 
@@ -98,6 +206,7 @@ func (b *bridge) processEvents() {
 	}
 
 	for {
+		atomic.StoreInt64(&b.processed, time.Now().UnixNano())
 		select {
 		case err := <-b.sess.LoggedInUpdates():
 			time.Sleep(2 * time.Second)
@@ -105,49 +214,46 @@ func (b *bridge) processEvents() {
 			if err != nil {
 				log.Error("Login? %s", err)
 			}
-			log.Info("Interface now available at http://localhost:%d/", *port)
-			b.ew.SendEvent("logged-in", err)
+			log.Info("Interface now available at http://%s/", b.cfg.Addr())
+			b.ew.SendEvent("logged-in", &LoggedInEvent{Error: newEventError(err)})
 		case <-b.sess.LoggedOutUpdates():
 			b.freeze()
 			log.Warning("Logged out. Interface thawed.")
-			b.ew.SendEvent("logged-out", nil)
+			b.ew.SendEvent("logged-out", &EmptyEvent{})
 			if stopping {
 				return
 			}
 		case err := <-b.sess.ConnectionErrorUpdates():
 			log.Error("Connection error: %s", err)
-			b.ew.SendEvent("connection-error", err)
+			b.ew.SendEvent("connection-error", &ErrorEvent{Error: newEventError(err)})
 		case msg := <-b.sess.MessagesToUser():
 			log.Error("Message to user: %s", msg)
-			b.ew.SendEvent("user-message", msg)
+			b.ew.SendEvent("user-message", &UserMessageEvent{Message: msg})
 		case <-b.sess.PlayTokenLostUpdates():
 			log.Warning("Play token lost.")
-			b.ew.SendEvent("play-token-lost", nil)
+			b.ew.SendEvent("play-token-lost", &EmptyEvent{})
 		case message := <-b.sess.LogMessages():
 			b.log(message)
 
 			// Pass the message through using server sent message
-			b.ew.SendEvent("log", struct {
-				Time    int64  `json:"time"`
-				Level   string `json:"level"`
-				Module  string `json:"module"`
-				Message string `json:"message"`
-			}{
-				message.Time.Unix(),
-				logLevels[message.Level],
-				message.Module,
-				message.Message,
+			b.ew.SendEvent("log", &LogEvent{
+				Time:    message.Time.Unix(),
+				Level:   logLevels[message.Level],
+				Module:  message.Module,
+				Message: message.Message,
 			})
 		case <-b.sess.EndOfTrackUpdates():
 			log.Info("End of track reached.")
 			b.player.EndOfTrack()
-			b.ew.SendEvent("track-end", nil)
+			b.ew.SendEvent("track-end", &EmptyEvent{})
 		case err := <-b.sess.StreamingErrors():
 			log.Info("Streaming errors: %s", err)
-			b.ew.SendEvent("streaming-error", err)
+			b.ew.SendEvent("streaming-error", &ErrorEvent{Error: newEventError(err)})
 		case <-b.sess.ConnectionStateUpdates():
 			log.Info("Connection state updates available.")
-			b.ew.SendEvent("connection-state", nil)
+			state := connectionStates[b.sess.ConnectionState()]
+			setConnectionState(state)
+			b.ew.SendEvent("connection-state", &ConnectionStateEvent{State: state})
 		case <-time.After(200 * time.Millisecond):
 			select {
 			case <-b.exit:
@@ -158,6 +264,8 @@ func (b *bridge) processEvents() {
 	}
 }
 
+// log writes the libspotify message to the log, as the module libspotify.X
+// where X is the libspotify module.
 func (b *bridge) log(m *spotify.LogMessage) {
 	var (
 		fmt  = "%s"
@@ -171,7 +279,7 @@ func (b *bridge) log(m *spotify.LogMessage) {
 		module = s[0]
 	}
 
-	logger := logging.MustGetLogger(module)
+	logger := logging.MustGetLogger("libspotify." + module)
 
 	switch m.Level {
 	case spotify.LogFatal:
@@ -189,38 +297,26 @@ func (b *bridge) log(m *spotify.LogMessage) {
 	}
 }
 
-type Track struct {
-	URI        string          `json:"uri"`
-	Name       string          `json:"name"`
-	Duration   float64         `json:"duration"`
-	Popularity float64         `json:"popularity"`
-	Album      *SimpleAlbum    `json:"album"`
-	Artists    []*SimpleArtist `json:"artists"`
-}
-
 func newTrack(t *spotify.Track) *Track {
+	if !t.IsLoaded() {
+		return &Track{URI: t.Link().String()}
+	}
 	album := newSimpleAlbum(t.Album())
 	var artists []*SimpleArtist
 	for i := 0; i < t.Artists(); i++ {
 		artists = append(artists, newSimpleArtist(t.Artist(i)))
 	}
 	return &Track{
-		t.Link().String(),
-		t.Name(),
-		t.Duration().Seconds(),
-		float64(t.Popularity()) / 100.,
-		album,
-		artists,
+		URI:        t.Link().String(),
+		Loaded:     true,
+		Name:       t.Name(),
+		Duration:   t.Duration().Seconds(),
+		Popularity: float64(t.Popularity()) / 100.,
+		Album:      album,
+		Artists:    artists,
 	}
 }
 
-type SimpleAlbum struct {
-	Id       string `json:"id"`
-	URI      string `json:"uri"`
-	Name     string `json:"name"`
-	HasImage bool   `json:"has_image"`
-}
-
 func newSimpleAlbum(a *spotify.Album) *SimpleAlbum {
 	uri := a.Link().String()
 	id := uri[strings.LastIndex(uri, ":")+1:]
@@ -228,87 +324,55 @@ func newSimpleAlbum(a *spotify.Album) *SimpleAlbum {
 	if _, err := a.Cover(spotify.ImageSizeSmall); err == nil {
 		hasImage = true
 	}
-	return &SimpleAlbum{id, a.Link().String(), a.Name(), hasImage}
-}
-
-type Album struct {
-	Id       string        `json:"id"`
-	URI      string        `json:"uri"`
-	Name     string        `json:"name"`
-	Year     int           `json:"year"`
-	HasImage bool          `json:"has_image"`
-	Artist   *SimpleArtist `json:"artist"`
+	return &SimpleAlbum{Id: id, URI: a.Link().String(), Name: a.Name(), HasImage: hasImage}
 }
 
 func newAlbum(a *spotify.Album) *Album {
 	// TODO do this in javascript, don't expose the "id"
 	uri := a.Link().String()
 	id := uri[strings.LastIndex(uri, ":")+1:]
+	if !a.IsLoaded() {
+		return &Album{Id: id, URI: uri}
+	}
 	hasImage := false
 	if _, err := a.Cover(spotify.ImageSizeSmall); err == nil {
 		hasImage = true
 	}
 	return &Album{
-		id,
-		a.Link().String(),
-		a.Name(),
-		a.Year(),
-		hasImage,
-		newSimpleArtist(a.Artist()),
+		Id:       id,
+		URI:      a.Link().String(),
+		Loaded:   true,
+		Name:     a.Name(),
+		Year:     a.Year(),
+		HasImage: hasImage,
+		Artist:   newSimpleArtist(a.Artist()),
 	}
 }
 
-type SimpleArtist struct {
-	URI  string `json:"uri"`
-	Name string `json:"name"`
-}
-
 func newSimpleArtist(a *spotify.Artist) *SimpleArtist {
-	return &SimpleArtist{a.Link().String(), a.Name()}
-}
-
-type Artist struct {
-	Id       string `json:"id"`
-	URI      string `json:"uri"`
-	Name     string `json:"name"`
-	HasImage bool   `json:"has_image"`
+	return &SimpleArtist{URI: a.Link().String(), Name: a.Name()}
 }
 
 func newArtist(a *spotify.Artist) *Artist {
 	// TODO do this in javascript, don't expose the "id"
 	uri := a.Link().String()
 	id := uri[strings.LastIndex(uri, ":")+1:]
+	if !a.IsLoaded() {
+		return &Artist{Id: id, URI: uri}
+	}
 	hasImage := false
 	if _, err := a.Portrait(spotify.ImageSizeSmall); err == nil {
 		hasImage = true
 	}
 	return &Artist{
-		id,
-		a.Link().String(),
-		a.Name(),
-		hasImage,
+		Id:       id,
+		URI:      a.Link().String(),
+		Loaded:   true,
+		Name:     a.Name(),
+		HasImage: hasImage,
 	}
 }
 
-type Playlist struct {
-	Id            string           `json:"id"`
-	URI           string           `json:"uri"`
-	Name          string           `json:"name"`
-	Description   string           `json:"description"`
-	Collaborative bool             `json:"collaborative"`
-	Subscribers   int              `json:"subscribers"`
-	Owner         string           `json:"owner"`
-	HasImage      bool             `json:"has_image"`
-	Items         []*PlaylistTrack `json:"items"`
-}
-
-type PlaylistTrack struct {
-	UID   string `json:"uid"`
-	User  string `json:"user"`
-	Time  string `json:"time"`
-	Track *Track `json:"track"`
-}
-
 func timeStr(t time.Time) string {
 	return t.Format("2006-01-02T03:04:05Z")
 }
@@ -316,10 +380,10 @@ func timeStr(t time.Time) string {
 func newPlaylistTrack(pt *spotify.PlaylistTrack) *PlaylistTrack {
 	track := newTrack(pt.Track())
 	return &PlaylistTrack{
-		playlistTrackUID(pt),
-		pt.User().CanonicalName(),
-		timeStr(pt.Time()),
-		track,
+		UID:   playlistTrackUID(pt),
+		User:  pt.User().CanonicalName(),
+		Time:  timeStr(pt.Time()),
+		Track: track,
 	}
 }
 
@@ -327,6 +391,9 @@ func newPlaylist(p *spotify.Playlist) *Playlist {
 	// TODO do this in javascript, don't expose the "id"
 	uri := p.Link().String()
 	id := uri[strings.LastIndex(uri, ":")+1:]
+	if !p.IsLoaded() {
+		return &Playlist{Id: id, URI: uri}
+	}
 
 	// TODO handle error
 	owner, _ := p.Owner()
@@ -338,53 +405,69 @@ func newPlaylist(p *spotify.Playlist) *Playlist {
 	}
 
 	return &Playlist{
-		id,
-		p.Link().String(),
-		p.Name(),
-		p.Description(),
-		p.Collaborative(),
-		p.NumSubscribers(),
-		owner.CanonicalName(),
-		hasImage,
-		nil,
+		Id:            id,
+		URI:           p.Link().String(),
+		Loaded:        true,
+		Name:          p.Name(),
+		Description:   p.Description(),
+		Collaborative: p.Collaborative(),
+		Subscribers:   p.NumSubscribers(),
+		Owner:         owner.CanonicalName(),
+		HasImage:      hasImage,
 	}
 }
 
-type PlaylistResult struct {
-	Playlist *Playlist `json:"playlist"`
-}
-
-type PlaylistsResult struct {
-	Playlists []*Playlist `json:"playlists"`
-}
-
-type SearchResult struct {
-	URI        string `json:"uri"`
-	DidYouMean string `json:"didyoumean"`
-
-	Artists []*Artist `json:"artists"`
-	Albums  []*Album  `json:"albums"`
-	Tracks  []*Track  `json:"tracks"`
-}
-
 type application struct {
+	auth        *auth
+	suggestions *suggester
+	history     *searchHistory
 }
 
 type searchArgs struct {
 	RawPage  int    `form:"page" json:"page"`
 	RawLimit int    `form:"limit" json:"limit"`
 	Query    string `form:"query" json:"query" binding:"required"`
+
+	// Type is a comma separated list of the types to search for, eg.
+	// artist,track. All types are searched for when empty.
+	Type string `form:"type" json:"type"`
+
+	// The offset and limit per type override the page and limit.
+	ArtistOffset   int `form:"artist_offset" json:"artist_offset"`
+	ArtistLimit    int `form:"artist_limit" json:"artist_limit"`
+	AlbumOffset    int `form:"album_offset" json:"album_offset"`
+	AlbumLimit     int `form:"album_limit" json:"album_limit"`
+	TrackOffset    int `form:"track_offset" json:"track_offset"`
+	TrackLimit     int `form:"track_limit" json:"track_limit"`
+	PlaylistOffset int `form:"playlist_offset" json:"playlist_offset"`
+	PlaylistLimit  int `form:"playlist_limit" json:"playlist_limit"`
 }
 
+// searchTypes are the types which can be searched for.
+var searchTypes = []string{"artist", "album", "track", "playlist"}
+
 func (sa searchArgs) Validate(errors *binding.Errors, req *http.Request) {
 	if sa.RawPage < 0 {
-		// TODO
+		errors.Fields["page"] = "must not be negative"
 	}
-
 	if sa.RawLimit < 0 {
-		// TODO
+		errors.Fields["limit"] = "must not be negative"
+	}
+	for name, v := range map[string]int{
+		"artist_offset": sa.ArtistOffset, "artist_limit": sa.ArtistLimit,
+		"album_offset": sa.AlbumOffset, "album_limit": sa.AlbumLimit,
+		"track_offset": sa.TrackOffset, "track_limit": sa.TrackLimit,
+		"playlist_offset": sa.PlaylistOffset, "playlist_limit": sa.PlaylistLimit,
+	} {
+		if v < 0 {
+			errors.Fields[name] = "must not be negative"
+		}
+	}
+	for t := range sa.types() {
+		if !containsString(searchTypes, t) {
+			errors.Fields["type"] = "unknown type: " + t
+		}
 	}
-	fmt.Println("limit", sa.Limit())
 }
 
 func (sa searchArgs) Page() int {
@@ -405,71 +488,150 @@ func (sa searchArgs) Offset() int {
 	return (sa.Page() - 1) * sa.Limit()
 }
 
+// firstPage reports if the first page of all types is searched for, as
+// opposed to paging through an earlier search.
+func (sa searchArgs) firstPage() bool {
+	return sa.Page() == 1 && sa.ArtistOffset == 0 && sa.AlbumOffset == 0 &&
+		sa.TrackOffset == 0 && sa.PlaylistOffset == 0
+}
+
+// types returns the set of requested types, or all if none were given.
+func (sa searchArgs) types() map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(sa.Type, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	if len(types) == 0 {
+		for _, t := range searchTypes {
+			types[t] = true
+		}
+	}
+	return types
+}
+
+// Options returns what to search for. Types which are not requested are left
+// with a zero count.
+func (sa searchArgs) Options() *spotify.SearchOptions {
+	types := sa.types()
+	spec := func(t string, offset, limit int) spotify.SearchSpec {
+		if !types[t] {
+			return spotify.SearchSpec{}
+		}
+		if offset == 0 {
+			offset = sa.Offset()
+		}
+		if limit == 0 {
+			limit = sa.Limit()
+		}
+		return spotify.SearchSpec{Offset: offset, Count: limit}
+	}
+	return &spotify.SearchOptions{
+		Artists:   spec("artist", sa.ArtistOffset, sa.ArtistLimit),
+		Albums:    spec("album", sa.AlbumOffset, sa.AlbumLimit),
+		Tracks:    spec("track", sa.TrackOffset, sa.TrackLimit),
+		Playlists: spec("playlist", sa.PlaylistOffset, sa.PlaylistLimit),
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // search queries the Spotify catalogue with the given query.
-func (a *application) search(bridge *bridge, enc encoder.Encoder, args searchArgs) (int, []byte) {
+func (a *application) search(bridge *bridge, enc encoder.Encoder, args searchArgs, info *requestInfo) (int, []byte) {
 	// requiredScopes := &scopes{search: true}
 	// if err := s.requireScopes(requiredScopes); err != nil {
 	// 	return nil, err
 	// }
 
-	bridge.sync()
-
-	// TODO make options
-	artists := true
-	albums := true
-	tracks := true
-
-	spec := spotify.SearchSpec{args.Offset(), args.Limit()}
-	opts := spotify.SearchOptions{}
-	if artists {
-		opts.Artists = spec
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
 	}
-	if albums {
-		opts.Albums = spec
+
+	result, err := bridge.search(args.Query, args.Options())
+	if err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
 	}
-	if tracks {
-		opts.Tracks = spec
+	if args.firstPage() {
+		a.history.Add(info.identity, args.Query, result.URI)
 	}
+	return http.StatusOK, encoder.Must(enc.Encode(result))
+}
+
+// trackSearch returns the options to search for tracks only.
+func trackSearch(offset, limit int) *spotify.SearchOptions {
+	return &spotify.SearchOptions{Tracks: spotify.SearchSpec{Offset: offset, Count: limit}}
+}
 
-	log.Debug("Searching %s...", args.Query)
-	search, err := bridge.sess.Search(args.Query, &opts)
+// search searches the catalogue for the types with a count in opts. Only the
+// types searched for are set in the result.
+func (b *bridge) search(query string, opts *spotify.SearchOptions) (*SearchResult, *apiError) {
+	defer observeLoad("search", time.Now())
+
+	log.Debug("Searching %s...", query)
+	search, err := b.cachedSearch(query, opts)
 	if err != nil {
-		// TODO serialize pretty error
-		log.Info(err.Error())
-		return http.StatusInternalServerError, nil
+		return nil, err
 	}
-	search.Wait()
 
-	result := SearchResult{
+	result := &SearchResult{
 		URI:        search.Link().String(),
 		DidYouMean: search.DidYouMean(),
+		Totals: SearchTotals{
+			Artists:   search.TotalArtists(),
+			Albums:    search.TotalAlbums(),
+			Tracks:    search.TotalTracks(),
+			Playlists: search.TotalPlaylists(),
+		},
 	}
-	if artists {
+	// Load the metadata of all items at once, rather than one at a time.
+	var objects []loadable
+	for i := 0; i < search.Artists(); i++ {
+		objects = append(objects, search.Artist(i))
+	}
+	for i := 0; i < search.Albums(); i++ {
+		objects = append(objects, search.Album(i))
+	}
+	for i := 0; i < search.Tracks(); i++ {
+		objects = append(objects, search.Track(i))
+	}
+	for i := 0; i < search.Playlists(); i++ {
+		objects = append(objects, search.Playlist(i))
+	}
+	loadAll("search", objects, loadTimeout)
+
+	if opts.Artists.Count > 0 {
 		result.Artists = make([]*Artist, 0, search.Artists())
 		for i := 0; i < search.Artists(); i++ {
-			artist := search.Artist(i)
-			artist.Wait()
-			result.Artists = append(result.Artists, newArtist(artist))
+			result.Artists = append(result.Artists, newArtist(search.Artist(i)))
 		}
 	}
-	if albums {
+	if opts.Albums.Count > 0 {
 		result.Albums = make([]*Album, 0, search.Albums())
 		for i := 0; i < search.Albums(); i++ {
-			album := search.Album(i)
-			album.Wait()
-			result.Albums = append(result.Albums, newAlbum(album))
+			result.Albums = append(result.Albums, newAlbum(search.Album(i)))
 		}
 	}
-	if tracks {
+	if opts.Tracks.Count > 0 {
 		result.Tracks = make([]*Track, 0, search.Tracks())
 		for i := 0; i < search.Tracks(); i++ {
-			track := search.Track(i)
-			track.Wait()
-			result.Tracks = append(result.Tracks, newTrack(track))
+			result.Tracks = append(result.Tracks, newTrack(search.Track(i)))
 		}
 	}
-
-	return http.StatusOK, encoder.Must(enc.Encode(result))
+	if opts.Playlists.Count > 0 {
+		result.Playlists = make([]*Playlist, 0, search.Playlists())
+		for i := 0; i < search.Playlists(); i++ {
+			result.Playlists = append(result.Playlists, newPlaylist(search.Playlist(i)))
+		}
+	}
+	return result, nil
 }
 
 type playlistsArgs struct {
@@ -495,45 +657,91 @@ func (pa playlistsArgs) Offset() int {
 	return (pa.Page() - 1) * pa.Limit()
 }
 
-func (pa playlistsArgs) OffLimit() int {
-	return pa.Offset() + pa.Limit()
-}
-
 // playlists returns the playlists for the user.
 func (a *application) playlists(bridge *bridge, enc encoder.Encoder, args playlistsArgs) (int, []byte) {
-	bridge.sync()
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
 
-	playlists, err := bridge.sess.Playlists()
+	r, err := bridge.playlists(args.Offset(), args.Limit())
+	if err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	return http.StatusOK, encoder.Must(enc.Encode(r))
+}
+
+// playlists lists the playlists of the logged in user.
+func (b *bridge) playlists(offset, limit int) (*PlaylistsResult, *apiError) {
+	defer observeLoad("playlists", time.Now())
+
+	playlists, err := b.sess.Playlists()
 	if err != nil {
 		log.Info(err.Error())
-		return http.StatusInternalServerError, nil
+		return nil, newInternalServerError(err.Error())
 	}
 
-	playlists.Wait()
+	if err := waitLoaded("playlists", playlists.Wait); err != nil {
+		return nil, err
+	}
 
-	r := PlaylistsResult{}
+	r := &PlaylistsResult{}
 
-	// Make this more asynchronous? We probably don't won't to wait for all metadata.
-	for i := args.Offset(); i < playlists.Playlists() && i < args.OffLimit(); i++ {
+	var page []*spotify.Playlist
+	var objects []loadable
+	for i := offset; i < playlists.Playlists() && i < offset+limit; i++ {
 		switch playlists.PlaylistType(i) {
 		case spotify.PlaylistTypePlaylist:
 			playlist := playlists.Playlist(i)
-			r.Playlists = append(r.Playlists, newPlaylist(playlist))
+			page = append(page, playlist)
+			objects = append(objects, playlist)
 		// TODO
 		case spotify.PlaylistTypeStartFolder:
 		case spotify.PlaylistTypeEndFolder:
 		case spotify.PlaylistTypePlaceholder:
 		}
 	}
+	loadAll("playlists", objects, loadTimeout)
+	for _, playlist := range page {
+		r.Playlists = append(r.Playlists, newPlaylist(playlist))
+	}
+	return r, nil
+}
 
-	return http.StatusOK, encoder.Must(enc.Encode(r))
+// imageSizes are the image sizes which can be requested, by name.
+var imageSizes = map[string]spotify.ImageSize{
+	"small":  spotify.ImageSizeSmall,
+	"normal": spotify.ImageSizeNormal,
+	"large":  spotify.ImageSizeLarge,
+}
+
+// imageSizeNames are the names of the image sizes, smallest first.
+var imageSizeNames = []string{"small", "normal", "large"}
+
+var albumTypes = map[spotify.AlbumType]string{
+	spotify.AlbumTypeAlbum:       "album",
+	spotify.AlbumTypeSingle:      "single",
+	spotify.AlbumTypeCompilation: "compilation",
+	spotify.AlbumTypeUnknown:     "unknown",
+}
+
+type imageArgs struct {
+	// Size is one of small, normal or large. Defaults to small.
+	Size string `form:"size" json:"size"`
 }
 
-func (a *application) image(w http.ResponseWriter, bridge *bridge, params martini.Params) (int, []byte) {
+func (a *application) image(w http.ResponseWriter, bridge *bridge, enc encoder.Encoder, args imageArgs, params martini.Params) (int, []byte) {
 	entity := params["entity"]
-	user := params["user"]
+	user := params["username"]
 	id := params["id"]
 
+	size := spotify.ImageSizeSmall
+	if args.Size != "" {
+		var ok bool
+		if size, ok = imageSizes[args.Size]; !ok {
+			return http.StatusBadRequest, nil
+		}
+	}
+
 	// TODO just use the raw uri and don't do any processing
 	var uri string
 	if entity == "playlist" {
@@ -555,7 +763,9 @@ func (a *application) image(w http.ResponseWriter, bridge *bridge, params martin
 			log.Info(err.Error())
 			return http.StatusInternalServerError, nil
 		}
-		playlist.Wait()
+		if err := waitLoaded("playlist "+uri, playlist.Wait); err != nil {
+			return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+		}
 		image, err = playlist.Image()
 		if err != nil {
 			return http.StatusInternalServerError, nil
@@ -566,8 +776,10 @@ func (a *application) image(w http.ResponseWriter, bridge *bridge, params martin
 			log.Info(err.Error())
 			return http.StatusInternalServerError, nil
 		}
-		album.Wait()
-		image, err = album.Cover(spotify.ImageSizeSmall)
+		if err := waitLoaded("album "+uri, album.Wait); err != nil {
+			return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+		}
+		image, err = album.Cover(size)
 		if err != nil {
 			return http.StatusInternalServerError, nil
 		}
@@ -577,8 +789,10 @@ func (a *application) image(w http.ResponseWriter, bridge *bridge, params martin
 			log.Info(err.Error())
 			return http.StatusInternalServerError, nil
 		}
-		artist.Wait()
-		image, err = artist.Portrait(spotify.ImageSizeSmall)
+		if err := waitLoaded("artist "+uri, artist.Wait); err != nil {
+			return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+		}
+		image, err = artist.Portrait(size)
 		if err != nil {
 			return http.StatusInternalServerError, nil
 		}
@@ -587,7 +801,9 @@ func (a *application) image(w http.ResponseWriter, bridge *bridge, params martin
 		return http.StatusBadRequest, nil
 	}
 
-	image.Wait()
+	if err := waitLoaded("image of "+uri, image.Wait); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
 	switch image.Format() {
 	case spotify.ImageFormatJpeg:
 		w.Header().Set("Content-Type", "application/jpeg")
@@ -620,103 +836,305 @@ func (pa playlistArgs) Offset() int {
 	return (pa.Page() - 1) * pa.Limit()
 }
 
-func (pa playlistArgs) OffLimit() int {
-	return pa.Offset() + pa.Limit()
-}
-
 // playlist returns a specific playlist
 func (a *application) playlist(bridge *bridge, enc encoder.Encoder, args playlistArgs, params martini.Params) (int, []byte) {
-	bridge.sync()
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
 
-	user := params["user"]
+	user := params["username"]
 	id := params["id"]
 	uri := fmt.Sprintf("spotify:user:%s:playlist:%s", user, id)
 
-	link, err := bridge.sess.ParseLink(uri)
+	r, err := bridge.playlist(uri, args.Offset(), args.Limit())
+	if err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	return http.StatusOK, encoder.Must(enc.Encode(r))
+}
+
+// playlist returns the playlist and the tracks in the range.
+func (b *bridge) playlist(uri string, offset, limit int) (*PlaylistResult, *apiError) {
+	defer observeLoad("playlist", time.Now())
+
+	link, err := b.sess.ParseLink(uri)
 	if err != nil {
 		log.Info(err.Error())
-		return http.StatusInternalServerError, nil
+		return nil, newBadRequestError("invalid playlist: " + uri)
 	}
 	if link.Type() != spotify.LinkTypePlaylist {
-		return http.StatusBadRequest, nil
+		return nil, newBadRequestError("not a playlist: " + uri)
 	}
 
 	playlist, err := link.Playlist()
 	if err != nil {
 		log.Info(err.Error())
-		return http.StatusInternalServerError, nil
+		return nil, newInternalServerError(err.Error())
 	}
 
-	playlist.Wait()
+	if err := waitLoaded("playlist "+uri, playlist.Wait); err != nil {
+		return nil, err
+	}
 
-	r := PlaylistResult{newPlaylist(playlist)}
+	r := &PlaylistResult{Playlist: newPlaylist(playlist)}
 
-	for i := args.Offset(); i < playlist.Tracks() && i < args.OffLimit(); i++ {
+	var page []*spotify.PlaylistTrack
+	var objects []loadable
+	for i := offset; i < playlist.Tracks() && i < offset+limit; i++ {
 		pt := playlist.Track(i)
+		page = append(page, pt)
+		objects = append(objects, pt.Track())
+	}
+	loadAll("playlist", objects, loadTimeout)
+	for _, pt := range page {
 		r.Playlist.Items = append(r.Playlist.Items, newPlaylistTrack(pt))
 	}
+	return r, nil
+}
 
+// album returns a specific album, including its tracks
+func (a *application) album(bridge *bridge, enc encoder.Encoder, params martini.Params) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+
+	uri := fmt.Sprintf("spotify:album:%s", params["id"])
+	r, err := bridge.album(uri)
+	if err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
 	return http.StatusOK, encoder.Must(enc.Encode(r))
 }
 
-func (a *application) play(bridge *bridge, enc encoder.Encoder) (int, []byte) {
-	bridge.sync()
+// browseAlbum browses the album, which loads its tracks and the metadata only
+// available through browsing.
+func (b *bridge) browseAlbum(uri string) (*spotify.AlbumBrowse, *apiError) {
+	link, err := b.sess.ParseLink(uri)
+	if err != nil {
+		log.Info(err.Error())
+		return nil, newBadRequestError("invalid album: " + uri)
+	}
+	if link.Type() != spotify.LinkTypeAlbum {
+		return nil, newBadRequestError("not an album: " + uri)
+	}
+
+	album, err := link.Album()
+	if err != nil {
+		log.Info(err.Error())
+		return nil, newInternalServerError(err.Error())
+	}
+
+	browse := album.Browse()
+	if err := waitLoaded("album "+uri, browse.Wait); err != nil {
+		return nil, err
+	}
+	if err := browse.Error(); err != nil {
+		log.Info("Failed to browse %s: %s", uri, err)
+		return nil, newNotFoundError("album not found: " + uri)
+	}
+	return browse, nil
+}
+
+// album returns the album with its full tracklist.
+func (b *bridge) album(uri string) (*AlbumResult, *apiError) {
+	defer observeLoad("album", time.Now())
+
+	browse, err := b.browseAlbum(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	album := browse.Album()
+	r := &AlbumResult{Album: newAlbum(album)}
+	r.Album.Type = albumTypes[album.Type()]
+	r.Album.Covers = []string{}
+	for _, name := range imageSizeNames {
+		if _, err := album.Cover(imageSizes[name]); err == nil {
+			r.Album.Covers = append(r.Album.Covers, name)
+		}
+	}
+	for i := 0; i < browse.Copyrights(); i++ {
+		r.Album.Copyrights = append(r.Album.Copyrights, browse.Copyright(i))
+	}
+	r.Album.Review = browse.Review()
+
+	var objects []loadable
+	for i := 0; i < browse.Tracks(); i++ {
+		objects = append(objects, browse.Track(i))
+	}
+	loadAll("album", objects, loadTimeout)
+	r.Album.Tracks = make([]*AlbumTrack, 0, browse.Tracks())
+	for i := 0; i < browse.Tracks(); i++ {
+		track := browse.Track(i)
+		r.Album.Tracks = append(r.Album.Tracks, &AlbumTrack{
+			Disc:  track.Disc(),
+			Index: track.Index(),
+			Track: newTrack(track),
+		})
+	}
+	return r, nil
+}
+
+func (a *application) play(bridge *bridge, enc encoder.Encoder, info *requestInfo) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	bridge.player.Resume(info.ID)
+	return http.StatusOK, nil
+}
 
-	player := bridge.sess.Player()
-	player.Play()
+func (a *application) pause(bridge *bridge, enc encoder.Encoder, info *requestInfo) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	bridge.player.Pause(info.ID)
+	return http.StatusOK, nil
+}
 
+func (a *application) next(bridge *bridge, enc encoder.Encoder, info *requestInfo) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	bridge.player.Next(info.ID)
 	return http.StatusOK, nil
 }
 
-func (a *application) pause(bridge *bridge, enc encoder.Encoder) (int, []byte) {
-	bridge.sync()
+func (a *application) status(bridge *bridge, audio *audioWriter, enc encoder.Encoder) (int, []byte) {
+	s := bridge.snapshot()
+	return http.StatusOK, encoder.Must(enc.Encode(&StatusResult{
+		LoggedIn: s.LoggedIn,
+		Playing:  s.Playing,
+		UID:      s.UID,
+		Track:    s.Track,
+		Volume:   audio.Volume(),
+	}))
+}
 
-	player := bridge.sess.Player()
-	player.Pause()
+func (a *application) queued(bridge *bridge, enc encoder.Encoder) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	queued := bridge.player.Queued()
+	objects := make([]loadable, len(queued))
+	for i, track := range queued {
+		objects[i] = track
+	}
+	loadAll("queue", objects, loadTimeout)
 
+	r := &QueueResult{Tracks: []*Track{}}
+	for _, track := range queued {
+		r.Tracks = append(r.Tracks, newTrack(track))
+	}
+	return http.StatusOK, encoder.Must(enc.Encode(r))
+}
+
+func (a *application) queue(bridge *bridge, enc encoder.Encoder, args queueArgs) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+
+	if _, err := bridge.player.Queue(args.URI); err != nil {
+		e := newBadRequestError(err.Error())
+		return e.StatusCode(), encoder.Must(enc.Encode(e.Data()))
+	}
+	return http.StatusOK, nil
+}
+
+func (a *application) seek(bridge *bridge, enc encoder.Encoder, args seekArgs) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	bridge.player.Seek(time.Duration(args.Position * float64(time.Second)))
 	return http.StatusOK, nil
 }
 
+func (a *application) volume(audio *audioWriter, enc encoder.Encoder) (int, []byte) {
+	return http.StatusOK, encoder.Must(enc.Encode(&VolumeResult{Volume: audio.Volume()}))
+}
+
+func (a *application) setVolume(audio *audioWriter, enc encoder.Encoder, args volumeArgs) (int, []byte) {
+	if args.Volume == nil {
+		e := newBadRequestError("volume is required")
+		return e.StatusCode(), encoder.Must(enc.Encode(e.Data()))
+	}
+	audio.SetVolume(*args.Volume)
+	return a.volume(audio, enc)
+}
+
 type loadArgs struct {
-	Context string `form:"ctx"`
-	Index   int    `form:"index"`
-	URI     string `form:"uri"`
-	Query   string `form:"query"`
+	Context string `form:"ctx" json:"ctx"`
+	Index   int    `form:"index" json:"index"`
+	URI     string `form:"uri" json:"uri"`
+	Query   string `form:"query" json:"query"`
+
+	// requestID is the request loading the context, if any.
+	requestID string
 }
 
-func (a *application) load(bridge *bridge, enc encoder.Encoder, args loadArgs) (int, []byte) {
-	bridge.sync()
+func (a *application) load(bridge *bridge, enc encoder.Encoder, args loadArgs, info *requestInfo) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	args.requestID = info.ID
+
+	if err := bridge.load(args); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	return http.StatusOK, nil
+}
 
-	ctxLink, err := bridge.sess.ParseLink(args.Context)
+// load starts playing the track at the given index of the context.
+func (b *bridge) load(args loadArgs) *apiError {
+	ctxLink, err := b.sess.ParseLink(args.Context)
 	if err != nil {
 		log.Info(err.Error())
-		return http.StatusBadRequest, nil
+		return newBadRequestError("invalid context: " + args.Context)
 	}
 	var tracks trackList
 	switch ctxLink.Type() {
 	case spotify.LinkTypePlaylist:
 		playlist, err := ctxLink.Playlist()
 		if err != nil {
-			return http.StatusInternalServerError, nil
+			return newInternalServerError(err.Error())
+		}
+		if err := waitLoaded("playlist "+args.Context, playlist.Wait); err != nil {
+			return err
 		}
-		playlist.Wait()
 		tracks = &playlistTracks{playlist}
 	case spotify.LinkTypeSearch:
+		query := args.Query
+		if query == "" {
+			if query, err = searchQuery(args.Context); err != nil {
+				return newBadRequestError("invalid context: " + args.Context)
+			}
+		}
 		// TODO get offset and limit as arguments (offset of search)
-		opts := spotify.SearchOptions{Tracks: spotify.SearchSpec{0, 50}}
-		search, err := bridge.sess.Search(args.Query, &opts)
-		if err != nil {
-			return http.StatusInternalServerError, nil
+		search, aerr := b.contextSearch(query, args.Index)
+		if aerr != nil {
+			return aerr
 		}
-		search.Wait()
 		tracks = &searchTracks{search}
+	case spotify.LinkTypeAlbum:
+		browse, aerr := b.browseAlbum(args.Context)
+		if aerr != nil {
+			return aerr
+		}
+		tracks = &albumTracks{browse}
+	case spotify.LinkTypeTrack:
+		track, err := ctxLink.Track()
+		if err != nil {
+			return newInternalServerError(err.Error())
+		}
+		if err := waitLoaded("track "+args.Context, track.Wait); err != nil {
+			return err
+		}
+		tracks = &singleTrack{track}
 	default:
-		return http.StatusBadRequest, nil
+		return newBadRequestError("unsupported context: " + args.Context)
 	}
 
-	if err = bridge.player.Play(tracks, args.Index); err != nil {
-		return http.StatusInternalServerError, nil
+	if err = b.player.Play(tracks, args.Index, args.requestID); err != nil {
+		return newInternalServerError(err.Error())
 	}
-
-	return http.StatusOK, nil
+	return nil
 }
@@ -0,0 +1,105 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/martini-contrib/binding"
+	"github.com/op/go-libspotify/spotify"
+)
+
+func TestSearchArgsOptions(t *testing.T) {
+	spec := func(offset, count int) spotify.SearchSpec {
+		return spotify.SearchSpec{Offset: offset, Count: count}
+	}
+	none := spotify.SearchSpec{}
+
+	var tests = []struct {
+		args searchArgs
+		opts spotify.SearchOptions
+	}{
+		// The page and limit default to the first 10 of each type.
+		{searchArgs{},
+			spotify.SearchOptions{Artists: spec(0, 10), Albums: spec(0, 10), Tracks: spec(0, 10), Playlists: spec(0, 10)}},
+		{searchArgs{RawPage: 3, RawLimit: 5},
+			spotify.SearchOptions{Artists: spec(10, 5), Albums: spec(10, 5), Tracks: spec(10, 5), Playlists: spec(10, 5)}},
+
+		// Types not requested are left out.
+		{searchArgs{Type: "track"},
+			spotify.SearchOptions{Artists: none, Albums: none, Tracks: spec(0, 10), Playlists: none}},
+		{searchArgs{Type: " artist , album,"},
+			spotify.SearchOptions{Artists: spec(0, 10), Albums: spec(0, 10), Tracks: none, Playlists: none}},
+		{searchArgs{Type: ","},
+			spotify.SearchOptions{Artists: spec(0, 10), Albums: spec(0, 10), Tracks: spec(0, 10), Playlists: spec(0, 10)}},
+
+		// The offset and limit of a type override the page.
+		{searchArgs{RawPage: 2, TrackOffset: 100, TrackLimit: 50, AlbumLimit: 1},
+			spotify.SearchOptions{Artists: spec(10, 10), Albums: spec(10, 1), Tracks: spec(100, 50), Playlists: spec(10, 10)}},
+		{searchArgs{Type: "playlist", ArtistLimit: 20, PlaylistOffset: 7},
+			spotify.SearchOptions{Artists: none, Albums: none, Tracks: none, Playlists: spec(7, 10)}},
+	}
+	for _, test := range tests {
+		if opts := test.args.Options(); !reflect.DeepEqual(*opts, test.opts) {
+			t.Errorf("%+v: %+v != %+v", test.args, *opts, test.opts)
+		}
+	}
+}
+
+func TestSearchArgsFirstPage(t *testing.T) {
+	var tests = []struct {
+		args  searchArgs
+		first bool
+	}{
+		{searchArgs{}, true},
+		{searchArgs{RawPage: 1, RawLimit: 50, TrackLimit: 20}, true},
+		{searchArgs{RawPage: 2}, false},
+		{searchArgs{TrackOffset: 10}, false},
+		{searchArgs{Type: "artist", PlaylistOffset: 10}, false},
+	}
+	for _, test := range tests {
+		if first := test.args.firstPage(); first != test.first {
+			t.Errorf("%+v: %v != %v", test.args, first, test.first)
+		}
+	}
+}
+
+func TestSearchArgsValidate(t *testing.T) {
+	var tests = []struct {
+		args   searchArgs
+		fields []string
+	}{
+		{searchArgs{Query: "q"}, []string{}},
+		{searchArgs{Query: "q", Type: "artist,album,track,playlist"}, []string{}},
+		{searchArgs{Query: "q", RawPage: -1}, []string{"page"}},
+		{searchArgs{Query: "q", RawLimit: -1}, []string{"limit"}},
+		{searchArgs{Query: "q", TrackOffset: -1, PlaylistLimit: -2}, []string{"playlist_limit", "track_offset"}},
+		{searchArgs{Query: "q", Type: "track,user"}, []string{"type"}},
+	}
+	for _, test := range tests {
+		errs := binding.Errors{Overall: map[string]string{}, Fields: map[string]string{}}
+		test.args.Validate(&errs, nil)
+		fields := []string{}
+		for name := range errs.Fields {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%+v: %v != %v", test.args, fields, test.fields)
+		}
+	}
+}
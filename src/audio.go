@@ -15,6 +15,8 @@
 package sith
 
 import (
+	"errors"
+	"fmt"
 	"runtime"
 	"sync"
 	"time"
@@ -45,7 +47,17 @@ type audio struct {
 
 // audioWriter takes audio from libspotify and outputs it through PortAudio.
 type audioWriter struct {
-	input chan audio
+	input  chan audio
+	device chan string
+
+	mu        sync.Mutex
+	volume    int
+	maxVolume int
+
+	// open is set while the stream is running, and streamErr holds the last
+	// failure to prepare it.
+	open      bool
+	streamErr error
 
 	quit chan bool
 	err  chan error
@@ -53,22 +65,42 @@ type audioWriter struct {
 }
 
 // newAudioWriter creates a new audioWriter handler.
-func newAudioWriter() (audioWriter, error) {
-	w := audioWriter{
-		input: make(chan audio, audioInputBufferSize),
-		quit:  make(chan bool, 1),
+func newAudioWriter(cfg *config) (*audioWriter, error) {
+	w := &audioWriter{
+		input:     make(chan audio, audioInputBufferSize),
+		device:    make(chan string, 1),
+		volume:    100,
+		maxVolume: cfg.MaxVolume,
+		quit:      make(chan bool, 1),
 	}
 
-	stream, err := newPortAudioStream()
+	stream, err := newPortAudioStream(cfg.AudioDevice)
 	if err != nil {
 		return w, err
 	}
 
+	w.open = true
 	w.wg.Add(1)
 	go w.streamWriter(stream)
 	return w, nil
 }
 
+// Ready returns an error unless the audio stream is open and working.
+func (w *audioWriter) Ready() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.open {
+		return errors.New("audio stream closed")
+	}
+	return w.streamErr
+}
+
+func (w *audioWriter) setStreamErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.streamErr = err
+}
+
 // Close stops and closes the audio stream and terminates PortAudio.
 func (w *audioWriter) Close() error {
 	w.quit <- true
@@ -80,12 +112,54 @@ func (w *audioWriter) Error() <-chan error {
 	return w.err
 }
 
+// SetDevice switches the output to the named device. The stream is re-opened
+// before the next delivery of audio.
+func (w *audioWriter) SetDevice(name string) {
+	select {
+	case <-w.device:
+	default:
+	}
+	w.device <- name
+}
+
+// Volume returns the current volume in percent.
+func (w *audioWriter) Volume() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.volume
+}
+
+// SetVolume sets the volume in percent, limited by the maximum volume.
+func (w *audioWriter) SetVolume(volume int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.volume = clampVolume(volume, w.maxVolume)
+}
+
+// SetMaxVolume sets the upper limit of the volume in percent.
+func (w *audioWriter) SetMaxVolume(maxVolume int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxVolume = clampVolume(maxVolume, 100)
+	w.volume = clampVolume(w.volume, w.maxVolume)
+}
+
+func clampVolume(volume, max int) int {
+	if volume < 0 {
+		return 0
+	} else if volume > max {
+		return max
+	}
+	return volume
+}
+
 // WriteAudio implements the spotify.AudioWriter interface.
 func (w *audioWriter) WriteAudio(format spotify.AudioFormat, frames []byte) int {
 	select {
 	case w.input <- audio{format, frames}:
 		return len(frames)
 	default:
+		audioDropped.Inc()
 		return 0
 	}
 }
@@ -95,6 +169,11 @@ func (w *audioWriter) WriteAudio(format spotify.AudioFormat, frames []byte) int
 func (w *audioWriter) streamWriter(stream portAudioStream) {
 	defer w.wg.Done()
 	defer stream.Close()
+	defer func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.open = false
+	}()
 
 	runtime.LockOSThread()
 	buffer := make([]int16, audioOutputBufferSize)
@@ -105,12 +184,18 @@ func (w *audioWriter) streamWriter(stream portAudioStream) {
 		var input audio
 		select {
 		case input = <-w.input:
+		case name := <-w.device:
+			if err := stream.SetDevice(name); err != nil {
+				log.Error("Failed to change audio device: %s", err)
+			}
+			continue
 		case <-w.quit:
 			return
 		}
 
 		// Initialize the audio stream based on the specification of the input format.
 		err := stream.Stream(&output, input.format.Channels, input.format.SampleRate)
+		w.setStreamErr(err)
 		if err != nil {
 			select {
 			case w.err <- err:
@@ -121,13 +206,16 @@ func (w *audioWriter) streamWriter(stream portAudioStream) {
 			continue
 		}
 
+		volume := int32(w.Volume())
+
 		// Decode the incoming data which is expected to be 2 channels and
 		// delivered as int16 in []byte, hence we need to convert it.
 		i := 0
 		for i < len(input.frames) {
 			j := 0
 			for j < len(buffer) && i < len(input.frames) {
-				buffer[j] = int16(input.frames[i]) | int16(input.frames[i+1])<<8
+				sample := int16(input.frames[i]) | int16(input.frames[i+1])<<8
+				buffer[j] = int16(int32(sample) * volume / 100)
 				j += 1
 				i += 2
 			}
@@ -148,23 +236,60 @@ type portAudioStream struct {
 	sampleRate int
 }
 
-// newPortAudioStream creates a new portAudioStream using the default output
-// device found on the system. It will also take care of automatically
-// initialise the PortAudio API.
-func newPortAudioStream() (portAudioStream, error) {
+// newPortAudioStream creates a new portAudioStream using the named output
+// device, or the default output device found on the system if empty. It will
+// also take care of automatically initialise the PortAudio API.
+func newPortAudioStream(name string) (portAudioStream, error) {
 	var s portAudioStream
 	if err := portaudio.Initialize(); err != nil {
 		return s, err
 	}
-	out, err := portaudio.DefaultHostApi()
+	device, err := outputDevice(name)
 	if err != nil {
 		portaudio.Terminate()
 		return s, err
 	}
-	s.device = out.DefaultOutputDevice
+	s.device = device
 	return s, nil
 }
 
+// outputDevice looks up the named output device, or the default output device
+// if the name is empty.
+func outputDevice(name string) (*portaudio.DeviceInfo, error) {
+	if name == "" {
+		out, err := portaudio.DefaultHostApi()
+		if err != nil {
+			return nil, err
+		}
+		return out.DefaultOutputDevice, nil
+	}
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.Name == name && device.MaxOutputChannels > 0 {
+			return device, nil
+		}
+	}
+	return nil, fmt.Errorf("audio device not found: %s", name)
+}
+
+// SetDevice closes any open stream and makes the next call to Stream use the
+// named device.
+func (s *portAudioStream) SetDevice(name string) error {
+	device, err := outputDevice(name)
+	if err != nil {
+		return err
+	}
+	if err := s.reset(); err != nil {
+		return err
+	}
+	s.device = device
+	s.stream = nil
+	return nil
+}
+
 // Close closes any open audio stream and terminates the PortAudio API.
 func (s *portAudioStream) Close() error {
 	if err := s.reset(); err != nil {
@@ -14,12 +14,123 @@
 
 package sith
 
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/martini-contrib/encoder"
+)
+
 // TODO add backend for storing users and acls
 type auth struct {
+	mu     sync.RWMutex
+	tokens map[string]bool
+}
+
+func newAuth(tokens []string) *auth {
+	a := &auth{}
+	a.SetTokens(tokens)
+	return a
+}
+
+// SetTokens replaces the set of accepted access tokens. When no tokens are
+// configured, all requests are accepted.
+func (a *auth) SetTokens(tokens []string) {
+	set := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		set[token] = true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens = set
+}
+
+// Valid reports if the token is accepted.
+func (a *auth) Valid(token string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.tokens) == 0 || a.tokens[token]
+}
+
+// tokenCookie is the cookie browsers can use to pass the access token.
+const tokenCookie = "sith_token"
+
+// requestToken returns the access token passed either as a bearer token, as
+// the oauth_token query parameter or in the token cookie.
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if token := r.URL.Query().Get("oauth_token"); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(tokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// publicPaths are served without a token, for load balancers and service
+// managers checking the health, and for browsers to log in.
+var publicPaths = map[string]bool{
+	"/healthz":            true,
+	"/readyz":             true,
+	"/auth/login":         true,
+	apiV1 + "/auth/login": true,
+}
+
+// Handler rejects any request which lacks a valid access token.
+func (a *auth) Handler(w http.ResponseWriter, r *http.Request, enc encoder.Encoder, info *requestInfo) {
+	if publicPaths[r.URL.Path] {
+		return
+	}
+	token := requestToken(r)
+	if token != "" {
+		info.identity = tokenIdentity(token)
+	}
+	if !a.Valid(token) {
+		err := newUnauthorizedError("missing or invalid access token")
+		w.WriteHeader(err.StatusCode())
+		w.Write(encoder.Must(enc.Encode(err.Data())))
+	}
+}
+
+type loginArgs struct {
+	Token string `form:"token" json:"token" binding:"required"`
+}
+
+// login verifies the token and hands it back to the browser in an HttpOnly
+// cookie, which the web interface and its event stream then authenticate
+// with.
+func (a *auth) login(w http.ResponseWriter, r *http.Request, enc encoder.Encoder, args loginArgs, info *requestInfo) (int, []byte) {
+	info.identity = tokenIdentity(args.Token)
+	if !a.Valid(args.Token) {
+		err := newUnauthorizedError("invalid access token")
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    args.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return http.StatusNoContent, nil
 }
 
-func newAuth() *auth {
-	return &auth{}
+// logout removes the token cookie.
+func (a *auth) logout(w http.ResponseWriter, r *http.Request) (int, []byte) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return http.StatusNoContent, nil
 }
 
 // TODO make this serializable
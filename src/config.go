@@ -0,0 +1,389 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/op/go-libspotify/spotify"
+	"github.com/op/go-logging"
+)
+
+// config holds the effective configuration. Values are resolved from the
+// defaults, the configuration file, the environment and the command line, in
+// that order, where the later ones take precedence.
+type config struct {
+	// path is the configuration file the values were read from, if any.
+	path string
+
+	Key      string `toml:"key"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+
+	Host  string `toml:"host"`
+	Port  int    `toml:"port"`
+	Color bool   `toml:"color"`
+
+	LogLevel    string            `toml:"log_level"`
+	LogLevels   map[string]string `toml:"log_levels"`
+	LogFormat   string            `toml:"log_format"`
+	LogFile     string            `toml:"log_file"`
+	LogMaxSize  int               `toml:"log_max_size"`
+	LogMaxFiles int               `toml:"log_max_files"`
+
+	Bitrate     int    `toml:"bitrate"`
+	AudioDevice string `toml:"audio_device"`
+	MaxVolume   int    `toml:"max_volume"`
+
+	Tokens            []string `toml:"tokens"`
+	LegacyRoutes      bool     `toml:"legacy_routes"`
+	UnversionedRoutes bool     `toml:"unversioned_routes"`
+
+	Webhooks []webhookConfig `toml:"webhooks"`
+
+	SyncTimeout    int `toml:"sync_timeout"`
+	SearchCacheTTL int `toml:"search_cache_ttl"`
+
+	MPDAddr string `toml:"mpd_addr"`
+	MPRIS   bool   `toml:"mpris"`
+
+	CacheDir    string `toml:"cache_dir"`
+	SettingsDir string `toml:"settings_dir"`
+	StateDir    string `toml:"state_dir"`
+	HTMLDir     string `toml:"html_dir"`
+}
+
+// bitrates maps the bitrate setting, in kbit/s, to what libspotify supports.
+var bitrates = map[int]spotify.Bitrate{
+	96:  spotify.Bitrate96k,
+	160: spotify.Bitrate160k,
+	320: spotify.Bitrate320k,
+}
+
+// setting binds a configuration value to its flag and environment variable.
+type setting struct {
+	flag  string
+	env   string
+	value interface{}
+}
+
+func (c *config) settings() []setting {
+	return []setting{
+		{"key", "SITH_KEY", &c.Key},
+		{"username", "SITH_USERNAME", &c.Username},
+		{"password", "SITH_PASSWORD", &c.Password},
+		{"host", "SITH_HOST", &c.Host},
+		{"port", "SITH_PORT", &c.Port},
+		{"color", "SITH_COLOR", &c.Color},
+		{"log-level", "SITH_LOG_LEVEL", &c.LogLevel},
+		{"log-levels", "SITH_LOG_LEVELS", &c.LogLevels},
+		{"log-format", "SITH_LOG_FORMAT", &c.LogFormat},
+		{"log-file", "SITH_LOG_FILE", &c.LogFile},
+		{"log-max-size", "SITH_LOG_MAX_SIZE", &c.LogMaxSize},
+		{"log-max-files", "SITH_LOG_MAX_FILES", &c.LogMaxFiles},
+		{"bitrate", "SITH_BITRATE", &c.Bitrate},
+		{"audio-device", "SITH_AUDIO_DEVICE", &c.AudioDevice},
+		{"max-volume", "SITH_MAX_VOLUME", &c.MaxVolume},
+		{"cache-dir", "SITH_CACHE_DIR", &c.CacheDir},
+		{"settings-dir", "SITH_SETTINGS_DIR", &c.SettingsDir},
+		{"state-dir", "SITH_STATE_DIR", &c.StateDir},
+		{"html-dir", "SITH_HTML_DIR", &c.HTMLDir},
+		{"legacy-routes", "SITH_LEGACY_ROUTES", &c.LegacyRoutes},
+		{"unversioned-routes", "SITH_UNVERSIONED_ROUTES", &c.UnversionedRoutes},
+		{"sync-timeout", "SITH_SYNC_TIMEOUT", &c.SyncTimeout},
+		{"search-cache-ttl", "SITH_SEARCH_CACHE_TTL", &c.SearchCacheTTL},
+		{"mpd-addr", "SITH_MPD_ADDR", &c.MPDAddr},
+		{"mpris", "SITH_MPRIS", &c.MPRIS},
+	}
+}
+
+// Addr returns the address the HTTP interface listens on.
+func (c *config) Addr() string {
+	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+}
+
+// URL returns the address of the HTTP interface, as reached locally.
+func (c *config) URL() string {
+	host := c.Host
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(c.Port)) + "/"
+}
+
+// DeadLetterPath returns the file where undeliverable webhook events are
+// written.
+func (c *config) DeadLetterPath() string {
+	return filepath.Join(c.StateDir, "webhooks.dead.log")
+}
+
+// SearchHistoryPath returns the file where the search history and saved
+// searches are kept.
+func (c *config) SearchHistoryPath() string {
+	return filepath.Join(c.StateDir, "searches.json")
+}
+
+// LogPath returns the file the log is written to when running the terminal
+// interface, unless a log file is configured.
+func (c *config) LogPath() string {
+	return filepath.Join(c.StateDir, prog+".log")
+}
+
+// xdgDir returns the directory for the given XDG base directory variable,
+// falling back to the specification default relative to the home directory.
+func xdgDir(env string, fallback ...string) string {
+	if dir := os.Getenv(env); dir != "" && filepath.IsAbs(dir) {
+		return filepath.Join(dir, prog)
+	}
+	home := os.Getenv("HOME")
+	return filepath.Join(append(append([]string{home}, fallback...), prog)...)
+}
+
+// defaultConfigPath returns the configuration file used when none is given.
+func defaultConfigPath() string {
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), prog+".toml")
+}
+
+// defaultConfig returns the configuration used before anything is read.
+func defaultConfig() *config {
+	configDir := xdgDir("XDG_CONFIG_HOME", ".config")
+	return &config{
+		Key:         filepath.Join(configDir, "spotify_appkey.key"),
+		Username:    "o.p",
+		Host:        "127.0.0.1",
+		Port:        8107,
+		Color:       true,
+		LogLevel:    "debug",
+		LogLevels:   map[string]string{"libspotify": "info"},
+		LogFormat:   "text",
+		LogMaxSize:  10,
+		LogMaxFiles: 5,
+		Bitrate:     160,
+		MaxVolume:   100,
+		CacheDir:    xdgDir("XDG_CACHE_HOME", ".cache"),
+		SettingsDir: filepath.Join(configDir, "libspotify"),
+		StateDir:    xdgDir("XDG_STATE_HOME", ".local", "state"),
+
+		UnversionedRoutes: true,
+		SyncTimeout:       30,
+		SearchCacheTTL:    300,
+		MPRIS:             true,
+	}
+}
+
+// loadConfig resolves the configuration. When path is empty, the default
+// configuration file is used if it exists.
+func loadConfig(path string, fs *flag.FlagSet) (*config, error) {
+	c := defaultConfig()
+
+	if path == "" {
+		path = os.Getenv("SITH_CONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigPath()); err == nil {
+			path = defaultConfigPath()
+		}
+	}
+	if path != "" {
+		md, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, undecoded[0].String())
+		}
+		c.path = path
+	}
+
+	for _, s := range c.settings() {
+		if v := os.Getenv(s.env); v != "" {
+			if err := setValue(s.value, v); err != nil {
+				return nil, fmt.Errorf("%s: %s", s.env, err)
+			}
+		}
+	}
+
+	if fs != nil {
+		var err error
+		fs.Visit(func(f *flag.Flag) {
+			for _, s := range c.settings() {
+				if s.flag == f.Name && err == nil {
+					if e := setValue(s.value, f.Value.String()); e != nil {
+						err = fmt.Errorf("-%s: %s", f.Name, e)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func setValue(value interface{}, s string) error {
+	switch v := value.(type) {
+	case *string:
+		*v = s
+	case *int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = i
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *map[string]string:
+		// Comma separated key=value pairs, merged with the current ones.
+		m := make(map[string]string)
+		for k, val := range *v {
+			m[k] = val
+		}
+		for _, pair := range strings.Split(s, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("expected key=value: %s", pair)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		*v = m
+	default:
+		panic("unhandled setting type")
+	}
+	return nil
+}
+
+// Validate verifies that the configuration can be used to start up.
+func (c *config) Validate() error {
+	if c.Username == "" {
+		return errors.New("username is required")
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("port out of range: %d", c.Port)
+	}
+	if _, err := logging.LogLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log level: %s", err)
+	}
+	for module, level := range c.LogLevels {
+		if _, err := logging.LogLevel(level); err != nil {
+			return fmt.Errorf("log level of %s: %s", module, err)
+		}
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("unsupported log format: %s", c.LogFormat)
+	}
+	if c.LogMaxSize < 0 || c.LogMaxFiles < 0 {
+		return errors.New("log max size and files must not be negative")
+	}
+	if _, ok := bitrates[c.Bitrate]; !ok {
+		return fmt.Errorf("unsupported bitrate: %d", c.Bitrate)
+	}
+	if c.SyncTimeout < 0 {
+		return fmt.Errorf("sync timeout must not be negative: %d", c.SyncTimeout)
+	}
+	if c.SearchCacheTTL < 0 {
+		return fmt.Errorf("search cache ttl must not be negative: %d", c.SearchCacheTTL)
+	}
+	if c.MaxVolume < 0 || c.MaxVolume > 100 {
+		return fmt.Errorf("max volume out of range: %d", c.MaxVolume)
+	}
+	if _, err := os.Stat(c.Key); err != nil {
+		return fmt.Errorf("app key: %s", err)
+	}
+	for _, w := range c.Webhooks {
+		u, err := url.Parse(w.URL)
+		if err != nil {
+			return fmt.Errorf("webhook: %s", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook: unsupported url: %s", w.URL)
+		}
+		for _, event := range w.Events {
+			if eventVersion(event) == 0 {
+				return fmt.Errorf("webhook: unknown event: %s", event)
+			}
+		}
+		if w.LogLevel != "" {
+			if _, err := logging.LogLevel(w.LogLevel); err != nil {
+				return fmt.Errorf("webhook: unknown log level: %s", w.LogLevel)
+			}
+		}
+	}
+	for _, dir := range []string{c.CacheDir, c.SettingsDir, c.StateDir} {
+		if dir == "" {
+			return errors.New("cache, settings and state directories are required")
+		}
+	}
+	return nil
+}
+
+// Write writes the configuration as TOML, masking any secrets.
+func (c *config) Write(w io.Writer) error {
+	masked := *c
+	if masked.Password != "" {
+		masked.Password = "********"
+	}
+	masked.Tokens = nil
+	for range c.Tokens {
+		masked.Tokens = append(masked.Tokens, "********")
+	}
+	masked.Webhooks = nil
+	for _, w := range c.Webhooks {
+		if w.Secret != "" {
+			w.Secret = "********"
+		}
+		masked.Webhooks = append(masked.Webhooks, w)
+	}
+	return toml.NewEncoder(w).Encode(masked)
+}
+
+// configCommand handles the config sub commands.
+func configCommand(c *config, args []string) int {
+	if len(args) != 1 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "usage: %s config check\n", prog)
+		return 2
+	}
+
+	if c.path != "" {
+		fmt.Printf("# %s\n", c.path)
+	} else {
+		fmt.Printf("# no configuration file, using defaults\n")
+	}
+	if err := c.Write(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", prog, err)
+		return 1
+	}
+	if err := c.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid configuration: %s\n", prog, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sith.toml")
+	data := "host = \"0.0.0.0\"\nport = 9000\nbitrate = 320\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SITH_PORT", "9001")
+	t.Setenv("SITH_AUDIO_DEVICE", "env")
+
+	fs := flag.NewFlagSet("sith", flag.ContinueOnError)
+	fs.Int("port", 0, "")
+	fs.String("audio-device", "", "")
+	if err := fs.Parse([]string{"-port", "9002"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(path, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.path != path {
+		t.Errorf("path: %q != %q", c.path, path)
+	}
+	if c.Port != 9002 {
+		t.Errorf("port: flag should override env and file: %d", c.Port)
+	}
+	if c.AudioDevice != "env" {
+		t.Errorf("audio device: env should apply when the flag is not set: %q", c.AudioDevice)
+	}
+	if c.Host != "0.0.0.0" || c.Bitrate != 320 {
+		t.Errorf("file values not applied: %q %d", c.Host, c.Bitrate)
+	}
+	if c.MaxVolume != 100 {
+		t.Errorf("default not kept: %d", c.MaxVolume)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sith.toml")
+	if err := os.WriteFile(path, []byte("unknown = 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path, nil); err == nil {
+		t.Error("expected error for unknown setting")
+	}
+
+	t.Setenv("SITH_PORT", "eighty")
+	if _, err := loadConfig(filepath.Join(dir, "missing.toml"), nil); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path, nil); err == nil {
+		t.Error("expected error for invalid environment value")
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	var (
+		s string
+		i int
+		b bool
+	)
+	var tests = []struct {
+		value interface{}
+		input string
+		want  interface{}
+		err   bool
+	}{
+		{&s, "foo", "foo", false},
+		{&s, "", "", false},
+		{&i, "42", 42, false},
+		{&i, "-1", -1, false},
+		{&i, "4x", nil, true},
+		{&b, "true", true, false},
+		{&b, "0", false, false},
+		{&b, "maybe", nil, true},
+	}
+	for _, test := range tests {
+		err := setValue(test.value, test.input)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		var got interface{}
+		switch v := test.value.(type) {
+		case *string:
+			got = *v
+		case *int:
+			got = *v
+		case *bool:
+			got = *v
+		}
+		if got != test.want {
+			t.Errorf("%q: %v != %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestSetValueMap(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  map[string]string
+		err   bool
+	}{
+		{"", map[string]string{"spotify": "info"}, false},
+		{"mpd=debug", map[string]string{"spotify": "info", "mpd": "debug"}, false},
+		{" mpd = debug , spotify=error,", map[string]string{"spotify": "error", "mpd": "debug"}, false},
+		{"a=b=c", map[string]string{"spotify": "info", "a": "b=c"}, false},
+		{"mpd", nil, true},
+	}
+	for _, test := range tests {
+		orig := map[string]string{"spotify": "info"}
+		m := orig
+		err := setValue(&m, test.input)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if !reflect.DeepEqual(m, test.want) {
+			t.Errorf("%q: %v != %v", test.input, m, test.want)
+		}
+		if len(orig) != 1 || orig["spotify"] != "info" {
+			t.Errorf("%q: original map modified: %v", test.input, orig)
+		}
+	}
+}
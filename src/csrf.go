@@ -0,0 +1,72 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/martini-contrib/encoder"
+)
+
+const (
+	// csrfCookie and csrfHeader are the names AngularJS uses for its built-in
+	// cross site request forgery protection.
+	csrfCookie = "XSRF-TOKEN"
+	csrfHeader = "X-XSRF-TOKEN"
+)
+
+// csrfHandler protects browsers from cross site request forgery using the
+// double submit cookie pattern. Every client is handed a random token in a
+// cookie, which must be sent back in a header for any state changing request.
+//
+// Clients authenticating through the Authorization header are exempt, since
+// browsers never add that header on their own, as are requests which neither
+// carry cookies nor an Origin, eg. from scripts.
+func csrfHandler(w http.ResponseWriter, r *http.Request, enc encoder.Encoder) {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		cookie = &http.Cookie{Name: csrfCookie, Value: newCSRFToken(), Path: "/"}
+		http.SetCookie(w, cookie)
+	}
+
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	if r.Header.Get("Authorization") != "" {
+		return
+	}
+	if r.Header.Get("Cookie") == "" && r.Header.Get("Origin") == "" {
+		return
+	}
+
+	token := r.Header.Get(csrfHeader)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		err := newForbiddenError("missing or invalid " + csrfHeader + " header")
+		w.WriteHeader(err.StatusCode())
+		w.Write(encoder.Must(enc.Encode(err.Data())))
+	}
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
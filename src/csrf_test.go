@@ -0,0 +1,88 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/martini-contrib/encoder"
+)
+
+func TestCSRFHandler(t *testing.T) {
+	const token = "0123456789abcdef"
+	var tests = []struct {
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		// Safe methods are never checked.
+		{"GET", nil, http.StatusOK},
+		{"HEAD", map[string]string{"Cookie": "sith_token=secret", "Origin": "http://evil"}, http.StatusOK},
+		{"OPTIONS", map[string]string{"Origin": "http://evil"}, http.StatusOK},
+
+		// Browsers never send the Authorization header on their own.
+		{"POST", map[string]string{"Authorization": "Bearer secret", "Origin": "http://evil"}, http.StatusOK},
+
+		// Scripts sending neither cookies nor an Origin are exempt.
+		{"POST", nil, http.StatusOK},
+		{"PUT", map[string]string{csrfHeader: "wrong"}, http.StatusOK},
+
+		// Browsers must send the token of the cookie in the header.
+		{"POST", map[string]string{"Cookie": csrfCookie + "=" + token}, http.StatusForbidden},
+		{"POST", map[string]string{"Cookie": csrfCookie + "=" + token, csrfHeader: "wrong"}, http.StatusForbidden},
+		{"POST", map[string]string{"Cookie": csrfCookie + "=" + token, csrfHeader: token}, http.StatusOK},
+		{"DELETE", map[string]string{"Cookie": csrfCookie + "=" + token, csrfHeader: token + "0"}, http.StatusForbidden},
+		{"POST", map[string]string{"Origin": "http://evil"}, http.StatusForbidden},
+		{"POST", map[string]string{"Origin": "http://evil", csrfHeader: token}, http.StatusForbidden},
+		{"PUT", map[string]string{"Cookie": "sith_token=secret", csrfHeader: token}, http.StatusForbidden},
+		{"POST", map[string]string{"Cookie": csrfCookie + "=", csrfHeader: ""}, http.StatusForbidden},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/v1/player/play", nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		csrfHandler(w, r, encoder.JsonEncoder{})
+		if w.Code != test.status {
+			t.Errorf("%d: %s %v: %d != %d", i, test.method, test.headers, w.Code, test.status)
+		}
+	}
+}
+
+func TestCSRFCookie(t *testing.T) {
+	// Clients without a token are handed one.
+	w := httptest.NewRecorder()
+	csrfHandler(w, httptest.NewRequest("GET", "/", nil), encoder.JsonEncoder{})
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || len(cookies[0].Value) != 32 || cookies[0].Path != "/" {
+		t.Fatalf("unexpected cookies: %v", cookies)
+	}
+
+	// The token is kept once handed out.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	csrfHandler(w, r, encoder.JsonEncoder{})
+	if c := w.Result().Cookies(); len(c) != 0 {
+		t.Errorf("expected the token to be kept: %v", c)
+	}
+
+	if newCSRFToken() == newCSRFToken() {
+		t.Error("expected random tokens")
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/op/sith/api"
+	"github.com/op/sith/client"
+)
+
+// errUsage is returned by ctl commands called with invalid arguments.
+var errUsage = errors.New("invalid arguments")
+
+// ctl controls a running instance through the HTTP API.
+type ctl struct {
+	client *client.Client
+	json   bool
+	out    io.Writer
+}
+
+// ctlAction is a sub command of ctl.
+type ctlAction struct {
+	name    string
+	args    string
+	summary string
+	run     func(c *ctl, args []string) error
+}
+
+var ctlActions = []ctlAction{
+	{"status", "", "show the playing track", (*ctl).status},
+	{"play", "", "resume playback", (*ctl).play},
+	{"pause", "", "pause playback", (*ctl).pause},
+	{"next", "", "skip to the next track", (*ctl).next},
+	{"load", "<uri> [index]", "play a track, or the track at index of a playlist or album", (*ctl).load},
+	{"queue", "add <uri> | list", "queue a track or list the queue", (*ctl).queue},
+	{"search", "<query>", "search for tracks", (*ctl).search},
+	{"volume", "[percent]", "show or set the volume", (*ctl).volume},
+	{"tail", "[event...]", "follow events, showing what is playing", (*ctl).tail},
+}
+
+// ctlToken returns the token to authenticate with, if any.
+func ctlToken(cfg *config) string {
+	if token := os.Getenv("SITH_TOKEN"); token != "" {
+		return token
+	}
+	if len(cfg.Tokens) > 0 {
+		return cfg.Tokens[0]
+	}
+	return ""
+}
+
+// ctlCommand handles the ctl sub commands.
+func ctlCommand(cfg *config, args []string) int {
+	fs := flag.NewFlagSet(prog+" ctl", flag.ContinueOnError)
+	baseURL := fs.String("url", cfg.URL(), "address of the instance to control")
+	token := fs.String("token", ctlToken(cfg), "token to authenticate with")
+	asJSON := fs.Bool("json", false, "output JSON instead of tables")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s ctl [flags] <command> [args]\n\ncommands:\n", prog)
+		w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+		for _, cmd := range ctlActions {
+			fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+		}
+		w.Flush()
+		fmt.Fprintf(os.Stderr, "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	c, err := client.New(*baseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", prog, err)
+		return 1
+	}
+	c.Token = *token
+
+	name := fs.Arg(0)
+	for _, cmd := range ctlActions {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(&ctl{client: c, json: *asJSON, out: os.Stdout}, fs.Args()[1:])
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: %s ctl %s %s\n", prog, cmd.name, cmd.args)
+			return 2
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", prog, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%s: unknown ctl command %q\n", prog, name)
+	return 2
+}
+
+// print writes v as JSON, or calls table to write it for humans.
+func (c *ctl) print(v interface{}, table func(w *tabwriter.Writer)) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func (c *ctl) status(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	s, err := c.client.Status()
+	if err != nil {
+		return err
+	}
+	return c.print(s, func(w *tabwriter.Writer) {
+		state := "stopped"
+		if s.Playing {
+			state = "playing"
+		} else if s.Track != nil {
+			state = "paused"
+		}
+		if !s.LoggedIn {
+			state += " (logged out)"
+		}
+		fmt.Fprintf(w, "State:\t%s\n", state)
+		if s.Track != nil {
+			fmt.Fprintf(w, "Track:\t%s\n", s.Track.Name)
+			fmt.Fprintf(w, "Artist:\t%s\n", trackArtists(s.Track))
+			if s.Track.Album != nil {
+				fmt.Fprintf(w, "Album:\t%s\n", s.Track.Album.Name)
+			}
+			fmt.Fprintf(w, "Length:\t%s\n", trackDuration(s.Track))
+			fmt.Fprintf(w, "URI:\t%s\n", s.Track.URI)
+		}
+		fmt.Fprintf(w, "Volume:\t%d%%\n", s.Volume)
+	})
+}
+
+func (c *ctl) play(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return c.client.Play()
+}
+
+func (c *ctl) pause(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return c.client.Pause()
+}
+
+func (c *ctl) next(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return c.client.Next()
+}
+
+func (c *ctl) load(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	req := &api.LoadRequest{Context: args[0]}
+	if len(args) == 2 {
+		index, err := strconv.Atoi(args[1])
+		if err != nil || index < 0 {
+			return errUsage
+		}
+		req.Index = index
+	}
+	return c.client.Load(req)
+}
+
+func (c *ctl) queue(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "add":
+		return c.client.Queue(args[1])
+	case len(args) == 1 && args[0] == "list":
+		tracks, err := c.client.Queued()
+		if err != nil {
+			return err
+		}
+		return c.print(tracks, func(w *tabwriter.Writer) { writeTracks(w, tracks) })
+	}
+	return errUsage
+}
+
+func (c *ctl) search(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	result, err := c.client.SearchWith(strings.Join(args, " "), &client.SearchOptions{Types: []string{"track"}})
+	if err != nil {
+		return err
+	}
+	return c.print(result, func(w *tabwriter.Writer) {
+		if result.DidYouMean != "" {
+			fmt.Fprintf(w, "Did you mean %q?\n\n", result.DidYouMean)
+		}
+		writeTracks(w, result.Tracks)
+	})
+}
+
+func (c *ctl) volume(args []string) error {
+	var volume int
+	var err error
+	switch len(args) {
+	case 0:
+		volume, err = c.client.Volume()
+	case 1:
+		v, perr := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+		if perr != nil {
+			return errUsage
+		}
+		volume, err = c.client.SetVolume(v)
+	default:
+		return errUsage
+	}
+	if err != nil {
+		return err
+	}
+	return c.print(&api.VolumeResult{Volume: volume}, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Volume:\t%d%%\n", volume)
+	})
+}
+
+// tail follows the events until the stream ends. Unless JSON is requested,
+// each event is written as a line, describing the playing track.
+func (c *ctl) tail(args []string) error {
+	query := url.Values{}
+	if len(args) > 0 {
+		query.Set("types", strings.Join(args, ","))
+	}
+	stream, err := c.client.Events(query)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	enc := json.NewEncoder(c.out)
+	for {
+		e, err := stream.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if c.json {
+			if err := enc.Encode(map[string]interface{}{
+				"id":    e.ID,
+				"event": e.Event,
+				"data":  e.Data,
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		now := time.Now().Format("15:04:05")
+		switch e.Event {
+		case "play-track", "state":
+			var data struct {
+				Track *api.Track `json:"track"`
+			}
+			if err := json.Unmarshal(e.Data, &data); err != nil {
+				return err
+			}
+			if data.Track != nil {
+				fmt.Fprintf(c.out, "%s  now playing: %s - %s (%s)\n", now,
+					trackArtists(data.Track), data.Track.Name, trackDuration(data.Track))
+			} else if e.Event == "state" {
+				fmt.Fprintf(c.out, "%s  stopped\n", now)
+			}
+		default:
+			fmt.Fprintf(c.out, "%s  %s %s\n", now, e.Event, e.Data)
+		}
+	}
+}
+
+// writeTracks writes a table of tracks.
+func writeTracks(w io.Writer, tracks []*api.Track) {
+	fmt.Fprintf(w, "#\tTRACK\tARTIST\tALBUM\tLENGTH\tURI\n")
+	for i, t := range tracks {
+		var album string
+		if t.Album != nil {
+			album = t.Album.Name
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", i, t.Name, trackArtists(t), album, trackDuration(t), t.URI)
+	}
+}
+
+func trackArtists(t *api.Track) string {
+	var names []string
+	for _, a := range t.Artists {
+		names = append(names, a.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func trackDuration(t *api.Track) string {
+	d := time.Duration(t.Duration) * time.Second
+	return fmt.Sprintf("%d:%02d", d/time.Minute, d%time.Minute/time.Second)
+}
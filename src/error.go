@@ -18,7 +18,6 @@ import (
 	"net/http"
 )
 
-// TODO these are no longer used, but should be..
 // apiError is the internal struct used to represent expected and handled
 // errors.
 type apiError struct {
@@ -46,6 +45,14 @@ func (e *apiError) StatusCode() int {
 	return e.status
 }
 
+func newBadRequestError(description string) *apiError {
+	return &apiError{
+		status:      http.StatusBadRequest,
+		Code:        "request_error",
+		Description: description,
+	}
+}
+
 func newForbiddenError(description string) *apiError {
 	return &apiError{
 		status:      http.StatusForbidden,
@@ -62,6 +69,30 @@ func newUnauthorizedError(description string) *apiError {
 	}
 }
 
+func newNotFoundError(description string) *apiError {
+	return &apiError{
+		status:      http.StatusNotFound,
+		Code:        "not_found",
+		Description: description,
+	}
+}
+
+func newConflictError(code, description string) *apiError {
+	return &apiError{
+		status:      http.StatusConflict,
+		Code:        code,
+		Description: description,
+	}
+}
+
+func newUnavailableError(description string) *apiError {
+	return &apiError{
+		status:      http.StatusServiceUnavailable,
+		Code:        "unavailable",
+		Description: description,
+	}
+}
+
 func newInternalServerError(description string) *apiError {
 	return &apiError{
 		status:      http.StatusInternalServerError,
@@ -16,59 +16,521 @@ package sith
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/antage/eventsource"
+	"github.com/martini-contrib/encoder"
 	"github.com/op/go-libspotify/spotify"
+	"github.com/op/go-logging"
 )
 
-const (
-	esIdleTimeout = 30 * time.Minute
-	esTimeout     = 5 * time.Second
+var (
+	// eventsHistorySize is the number of events kept around to be replayed to
+	// clients reconnecting with a Last-Event-ID.
+	eventsHistorySize = 256
+
+	// eventsSubscriberBuffer is the number of events buffered for each client
+	// before it is considered too slow and disconnected. The client will
+	// reconnect and get the missed events replayed.
+	eventsSubscriberBuffer = 64
+
+	// eventsPingInterval is the interval to send comments to keep idle
+	// connections open through proxies.
+	eventsPingInterval = 30 * time.Second
+
+	// eventsRetry is the reconnection delay suggested to clients.
+	eventsRetry = 3 * time.Second
 )
 
-type EventsWriter struct {
-	es eventsource.EventSource
+// Event is a single event sent to clients.
+type Event struct {
+	ID   uint64
+	Type string
+	Data []byte
+
+	// level is the log level for log events.
+	level logging.Level
+
+	// time is when the event was sent.
+	time time.Time
+}
+
+// leveled is implemented by event data which carries a log level.
+type leveled interface {
+	logLevel() logging.Level
+}
+
+// eventsVersion is the version of the event catalogue. It is bumped whenever
+// an event changes in an incompatible way, together with the version of the
+// event itself.
+const eventsVersion = 1
+
+// eventHeader is embedded in every event and carries the version of the event
+// payload. RequestID is the id of the API request which caused the event, if
+// any, as returned in the X-Request-Id header.
+type eventHeader struct {
+	Version   int    `json:"version"`
+	RequestID string `json:"request_id,omitempty"`
+}
 
-	// TODO base on timestamp?
-	sequenceId int
+func (h *eventHeader) setVersion(version int) {
+	h.Version = version
 }
 
-// TODO this should not be kept here?
+// versioned is implemented by all events embedding eventHeader.
+type versioned interface {
+	setVersion(int)
+}
+
+// EventError is an error serialized as part of an event.
+type EventError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
 
-func NewEventsWriter() EventsWriter {
-	esSettings := eventsource.Settings{
-		CloseOnTimeout: false,
-		IdleTimeout:    esIdleTimeout,
-		Timeout:        esTimeout,
+func newEventError(err error) *EventError {
+	if err == nil {
+		return nil
+	}
+	switch e := err.(type) {
+	case *apiError:
+		return &EventError{e.Code, e.Description}
+	case spotify.Error:
+		return &EventError{fmt.Sprintf("spotify_error_%d", int(e)), e.Error()}
 	}
-	es := eventsource.New(&esSettings, nil)
-	return EventsWriter{es, 0}
+	return &EventError{"error", err.Error()}
 }
 
-func (ew *EventsWriter) Close() error {
-	ew.es.Close()
-	return nil
+// ErrorEvent is sent for errors reported by the session.
+type ErrorEvent struct {
+	eventHeader
+	Error *EventError `json:"error"`
 }
 
-func (ew *EventsWriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ew.es.ServeHTTP(w, r)
+// LoggedInEvent is sent when a login attempt has finished. Error is set if
+// the login failed.
+type LoggedInEvent struct {
+	eventHeader
+	Error *EventError `json:"error"`
+}
+
+// EmptyEvent is sent for events which carry no other information.
+type EmptyEvent struct {
+	eventHeader
+}
+
+// UserMessageEvent carries a message from the access point to the user.
+type UserMessageEvent struct {
+	eventHeader
+	Message string `json:"message"`
+}
+
+// ConnectionStateEvent is sent when the connection state changes.
+type ConnectionStateEvent struct {
+	eventHeader
+	State string `json:"state"`
+}
+
+// PlayTrackEvent is sent when a track starts playing.
+type PlayTrackEvent struct {
+	eventHeader
+	UID   string `json:"uid"`
+	Track *Track `json:"track"`
+}
+
+// PlayerStateEvent is sent when playback is paused or resumed. Position is in
+// seconds.
+type PlayerStateEvent struct {
+	eventHeader
+	Playing  bool    `json:"playing"`
+	Position float64 `json:"position"`
+}
+
+// PlayTrackFailedEvent is sent when a track fails to load.
+type PlayTrackFailedEvent struct {
+	eventHeader
+	URI   string      `json:"uri"`
+	Error *EventError `json:"error"`
+}
+
+// LinkEvent refers to a Spotify entity.
+type LinkEvent struct {
+	eventHeader
+	URI string `json:"uri"`
+}
+
+// LogEvent is the data of the log event, forwarding log messages.
+type LogEvent struct {
+	eventHeader
+	Time    int64  `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module"`
+	Message string `json:"message"`
+}
+
+func (e *LogEvent) logLevel() logging.Level {
+	if e.Level == "fatal" {
+		return logging.CRITICAL
+	}
+	level, err := logging.LogLevel(e.Level)
+	if err != nil {
+		return logging.DEBUG
+	}
+	return level
+}
+
+// StateSnapshot is sent as the state event to clients which have no or too old
+// knowledge of previous events.
+type StateSnapshot struct {
+	eventHeader
+	LoggedIn bool   `json:"logged_in"`
+	Playing  bool   `json:"playing"`
+	UID      string `json:"uid,omitempty"`
+	Track    *Track `json:"track"`
+}
+
+// eventType describes an event in the catalogue.
+type eventType struct {
+	name        string
+	version     int
+	description string
+	data        interface{}
+}
+
+// eventTypes is the catalogue of all events sent to clients.
+var eventTypes = []eventType{
+	{"connection-error", 1, "The connection to Spotify failed.", ErrorEvent{}},
+	{"connection-state", 1, "The connection state changed.", ConnectionStateEvent{}},
+	{"log", 1, "A log message from libspotify.", LogEvent{}},
+	{"logged-in", 1, "A login attempt finished, successfully unless error is set.", LoggedInEvent{}},
+	{"logged-out", 1, "The session was logged out.", EmptyEvent{}},
+	{"play-token-lost", 1, "Playback paused since the account is used elsewhere.", EmptyEvent{}},
+	{"play-track", 1, "A track started playing.", PlayTrackEvent{}},
+	{"play-track-failed", 1, "A track could not be played.", PlayTrackFailedEvent{}},
+	{"player-state", 1, "Playback was paused or resumed.", PlayerStateEvent{}},
+	{"state", 1, "The current state, sent when events have been missed.", StateSnapshot{}},
+	{"streaming-error", 1, "Streaming of the playing track failed.", ErrorEvent{}},
+	{"track-end", 1, "The playing track reached its end.", EmptyEvent{}},
+	{"user-message", 1, "A message to the user from the access point.", UserMessageEvent{}},
+}
+
+// eventVersion returns the version of the event, or 0 if the event is unknown.
+func eventVersion(name string) int {
+	for _, t := range eventTypes {
+		if t.name == name {
+			return t.version
+		}
+	}
+	return 0
+}
+
+// EventSchema describes an event in the catalogue.
+type EventSchema struct {
+	Name        string `json:"name"`
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Schema      schema `json:"schema"`
+}
+
+// EventCatalogue lists all events sent to clients.
+type EventCatalogue struct {
+	Version int            `json:"version"`
+	Events  []*EventSchema `json:"events"`
+}
+
+func newEventCatalogue() *EventCatalogue {
+	c := &EventCatalogue{Version: eventsVersion}
+	for _, t := range eventTypes {
+		c.Events = append(c.Events, &EventSchema{
+			t.name,
+			t.version,
+			t.description,
+			jsonSchema(reflect.TypeOf(t.data)),
+		})
+	}
+	return c
+}
+
+// eventFilter selects which events a client receives.
+type eventFilter struct {
+	// types is the set of event types to deliver, or all if empty.
+	types map[string]bool
+
+	// level is the minimum level of log events to deliver.
+	level logging.Level
+}
+
+// newEventFilter creates a filter from the types and log_level query
+// parameters, eg. types=play-track,log&log_level=warning.
+func newEventFilter(r *http.Request) (eventFilter, error) {
+	f := eventFilter{types: make(map[string]bool), level: logging.DEBUG}
+	q := r.URL.Query()
+	for _, types := range q["types"] {
+		for _, t := range strings.Split(types, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				f.types[t] = true
+			}
+		}
+	}
+	if level := q.Get("log_level"); level != "" {
+		var err error
+		if f.level, err = logging.LogLevel(level); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
 }
 
+// Match reports if the event should be delivered. The state event is always
+// delivered since it is what brings the client up to date.
+func (f eventFilter) Match(e Event) bool {
+	if e.Type == "state" {
+		return true
+	}
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+	return e.Type != "log" || e.level <= f.level
+}
+
+type subscriber struct {
+	filter eventFilter
+	events chan Event
+}
+
+// EventsWriter distributes events to any connected clients. It keeps a bounded
+// history of recent events which is replayed to reconnecting clients.
+type EventsWriter struct {
+	mu          sync.Mutex
+	sequenceId  uint64
+	history     []Event
+	subscribers map[*subscriber]bool
+	snapshot    func() *StateSnapshot
+	closed      bool
+}
+
+func NewEventsWriter() *EventsWriter {
+	return &EventsWriter{
+		history:     make([]Event, eventsHistorySize),
+		subscribers: make(map[*subscriber]bool),
+	}
+}
+
+// SetSnapshot sets the function used to describe the current state.
+func (ew *EventsWriter) SetSnapshot(snapshot func() *StateSnapshot) {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	ew.snapshot = snapshot
+}
+
+func (ew *EventsWriter) Close() error {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	ew.closed = true
+	for s := range ew.subscribers {
+		close(s.events)
+		delete(ew.subscribers, s)
+	}
+	return nil
+}
+
+// SendEvent sends the event to all subscribers. The data should be one of the
+// event types listed in the catalogue.
 func (ew *EventsWriter) SendEvent(event string, data interface{}) error {
-	ew.sequenceId++
+	version := eventVersion(event)
+	if version == 0 {
+		log.Warning("Sending unknown event: %s", event)
+	}
+	if v, ok := data.(versioned); ok {
+		v.setVersion(version)
+	}
 	bytes, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
-	ew.es.SendEventMessage(string(bytes), event, strconv.Itoa(ew.sequenceId))
+
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	if ew.closed {
+		return nil
+	}
+
+	eventsTotal.WithLabelValues(event).Inc()
+	ew.sequenceId++
+	e := Event{ID: ew.sequenceId, Type: event, Data: bytes, time: time.Now()}
+	if l, ok := data.(leveled); ok {
+		e.level = l.logLevel()
+	}
+	ew.history[e.ID%uint64(len(ew.history))] = e
+
+	for s := range ew.subscribers {
+		if !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			// Drop the client, it will reconnect and catch up.
+			close(s.events)
+			delete(ew.subscribers, s)
+		}
+	}
 	return nil
 }
 
 func (ew *EventsWriter) SendLink(event string, link *spotify.Link) error {
-	return ew.SendEvent(event, struct {
-		URI string `json:"uri"`
-	}{link.String()})
+	return ew.SendEvent(event, &LinkEvent{URI: link.String()})
+}
+
+// schema serves the event catalogue.
+func (ew *EventsWriter) schema(enc encoder.Encoder) (int, []byte) {
+	return http.StatusOK, encoder.Must(enc.Encode(newEventCatalogue()))
+}
+
+// subscribe registers a new subscriber and returns the events it has missed
+// since lastId. If the events are no longer available, or lastId is unknown, a
+// state snapshot is returned instead.
+func (ew *EventsWriter) subscribe(lastId string, filter eventFilter) (*subscriber, []Event) {
+	ew.mu.Lock()
+	s := &subscriber{filter, make(chan Event, eventsSubscriberBuffer)}
+	if ew.closed {
+		close(s.events)
+		ew.mu.Unlock()
+		return s, nil
+	}
+	ew.subscribers[s] = true
+
+	if id, err := strconv.ParseUint(lastId, 10, 64); err == nil && id <= ew.sequenceId {
+		if ew.sequenceId-id <= uint64(len(ew.history)) {
+			var missed []Event
+			for i := id + 1; i <= ew.sequenceId; i++ {
+				if e := ew.history[i%uint64(len(ew.history))]; filter.Match(e) {
+					missed = append(missed, e)
+				}
+			}
+			ew.mu.Unlock()
+			return s, missed
+		}
+	}
+	id, snapshot := ew.sequenceId, ew.snapshot
+	ew.mu.Unlock()
+
+	// The snapshot is taken after subscribing, without holding the lock, since
+	// describing the state might end up sending events. Any event queued in the
+	// meantime is already part of the state, and applying it again is harmless.
+	if snapshot == nil {
+		return s, nil
+	}
+	state := snapshot()
+	state.setVersion(eventVersion("state"))
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Error("Failed to serialize state: %s", err)
+		return s, nil
+	}
+	return s, []Event{{ID: id, Type: "state", Data: data}}
+}
+
+// follow calls f with the events matching the filter until the writer is
+// closed, subscribing again whenever dropped. The state describing where to
+// start from is only passed on if initial is set.
+func (ew *EventsWriter) follow(filter eventFilter, initial bool, f func(e Event)) {
+	var lastId string
+	for {
+		s, missed := ew.subscribe(lastId, filter)
+		if lastId == "" && !initial {
+			missed = nil
+		}
+		for _, e := range missed {
+			f(e)
+			lastId = strconv.FormatUint(e.ID, 10)
+		}
+		for e := range s.events {
+			f(e)
+			lastId = strconv.FormatUint(e.ID, 10)
+		}
+
+		ew.mu.Lock()
+		closed := ew.closed
+		ew.mu.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+func (ew *EventsWriter) unsubscribe(s *subscriber) {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	if ew.subscribers[s] {
+		close(s.events)
+		delete(ew.subscribers, s)
+	}
+}
+
+// ServeHTTP streams the events to the client using server sent events. The
+// events can be limited using the types and log_level query parameters.
+func (ew *EventsWriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := newEventFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("lastEventId")
+	}
+	s, missed := ew.subscribe(lastId, filter)
+	defer ew.unsubscribe(s)
+	sseSubscribers.Inc()
+	defer sseSubscribers.Dec()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry/time.Millisecond)
+	for _, e := range missed {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	return err
 }
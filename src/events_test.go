@@ -0,0 +1,187 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+// newTestEventsWriter creates an events writer keeping size events, with a
+// snapshot describing a stopped player.
+func newTestEventsWriter(t *testing.T, size int) *EventsWriter {
+	old := eventsHistorySize
+	eventsHistorySize = size
+	t.Cleanup(func() { eventsHistorySize = old })
+
+	ew := NewEventsWriter()
+	ew.SetSnapshot(func() *StateSnapshot { return &StateSnapshot{} })
+	t.Cleanup(func() { ew.Close() })
+	return ew
+}
+
+func sendEvents(t *testing.T, ew *EventsWriter, n int) {
+	for i := 0; i < n; i++ {
+		if err := ew.SendEvent("track-end", &EmptyEvent{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func eventIDs(events []Event) []uint64 {
+	ids := []uint64{}
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestEventsReplay(t *testing.T) {
+	var tests = []struct {
+		sent   int
+		lastID string
+		ids    []uint64
+		state  bool
+	}{
+		// Everything after the last id is replayed while still kept.
+		{3, "1", []uint64{2, 3}, false},
+		{3, "0", []uint64{1, 2, 3}, false},
+		{3, "3", []uint64{}, false},
+		{10, "6", []uint64{7, 8, 9, 10}, false},
+
+		// The state is sent for new clients, unknown ids and missed events
+		// which are no longer kept.
+		{3, "", []uint64{3}, true},
+		{3, "foo", []uint64{3}, true},
+		{3, "4", []uint64{3}, true},
+		{10, "5", []uint64{10}, true},
+	}
+	for _, test := range tests {
+		ew := newTestEventsWriter(t, 4)
+		sendEvents(t, ew, test.sent)
+
+		s, missed := ew.subscribe(test.lastID, eventFilter{})
+		ew.unsubscribe(s)
+		if ids := eventIDs(missed); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%d/%q: %v != %v", test.sent, test.lastID, ids, test.ids)
+		}
+		state := len(missed) == 1 && missed[0].Type == "state"
+		if state != test.state {
+			t.Errorf("%d/%q: state %v != %v", test.sent, test.lastID, state, test.state)
+		}
+	}
+}
+
+func TestEventsSlowSubscriber(t *testing.T) {
+	old := eventsSubscriberBuffer
+	eventsSubscriberBuffer = 2
+	defer func() { eventsSubscriberBuffer = old }()
+
+	ew := newTestEventsWriter(t, 8)
+	s, _ := ew.subscribe("", eventFilter{})
+	sendEvents(t, ew, 3)
+
+	var ids []uint64
+	for e := range s.events {
+		ids = append(ids, e.ID)
+	}
+	if !reflect.DeepEqual(ids, []uint64{1, 2}) {
+		t.Errorf("expected the buffered events before being dropped: %v", ids)
+	}
+
+	// Reconnecting replays what was missed.
+	s, missed := ew.subscribe("2", eventFilter{})
+	ew.unsubscribe(s)
+	if ids := eventIDs(missed); !reflect.DeepEqual(ids, []uint64{3}) {
+		t.Errorf("missed: %v", ids)
+	}
+}
+
+func TestEventsLastEventID(t *testing.T) {
+	ew := newTestEventsWriter(t, 4)
+	sendEvents(t, ew, 3)
+
+	server := httptest.NewServer(ew)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type: %s", ct)
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && len(ids) < 2 {
+		if line := scanner.Text(); strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"2", "3"}) {
+		t.Errorf("replayed: %v", ids)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	var tests = []struct {
+		query string
+		event Event
+		match bool
+	}{
+		{"", Event{Type: "play-track"}, true},
+		{"", Event{Type: "log", level: logging.DEBUG}, true},
+		{"types=play-track,track-end", Event{Type: "track-end"}, true},
+		{"types=play-track&types=track-end", Event{Type: "track-end"}, true},
+		{"types=play-track", Event{Type: "track-end"}, false},
+		{"types=play-track", Event{Type: "state"}, true},
+		{"types=log&log_level=warning", Event{Type: "log", level: logging.ERROR}, true},
+		{"types=log&log_level=warning", Event{Type: "log", level: logging.WARNING}, true},
+		{"types=log&log_level=warning", Event{Type: "log", level: logging.INFO}, false},
+		{"log_level=critical", Event{Type: "play-track"}, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/events?"+test.query, nil)
+		f, err := newEventFilter(r)
+		if err != nil {
+			t.Errorf("%s: %s", test.query, err)
+			continue
+		}
+		if match := f.Match(test.event); match != test.match {
+			t.Errorf("%s: %s: %v != %v", test.query, test.event.Type, match, test.match)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/events?log_level=loud", nil)
+	if _, err := newEventFilter(r); err == nil {
+		t.Error("expected error for unknown log level")
+	}
+}
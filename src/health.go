@@ -0,0 +1,80 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// health answers liveness and readiness probes.
+type health struct {
+	bridge *bridge
+	audio  *audioWriter
+}
+
+// checks returns the state of each part needed to play music.
+func (h *health) checks() (map[string]string, bool) {
+	checks := map[string]string{"session": "ok", "audio": "ok", "player": "ok"}
+	ready := true
+	if !h.bridge.Running() {
+		checks["session"] = "not logged in"
+		ready = false
+	}
+	if err := h.audio.Ready(); err != nil {
+		checks["audio"] = err.Error()
+		ready = false
+	}
+	if !h.bridge.player.Running() {
+		checks["player"] = "not running"
+		ready = false
+	}
+	return checks, ready
+}
+
+// Alive reports if the session events have been processed within the
+// duration and the player loop is running, ie. that nothing is stuck.
+func (h *health) Alive(d time.Duration) bool {
+	return h.bridge.Responsive(d) && h.bridge.player.Running()
+}
+
+// Ready reports if the session, audio and player are all available.
+func (h *health) Ready() bool {
+	_, ready := h.checks()
+	return ready
+}
+
+// healthz reports that the process is alive and serving requests.
+func (h *health) healthz(w http.ResponseWriter) {
+	writeHealth(w, http.StatusOK, &HealthResult{Status: "ok"})
+}
+
+// readyz reports if the instance is ready to play music.
+func (h *health) readyz(w http.ResponseWriter) {
+	checks, ready := h.checks()
+	if !ready {
+		writeHealth(w, http.StatusServiceUnavailable, &HealthResult{Status: "unavailable", Checks: checks})
+		return
+	}
+	writeHealth(w, http.StatusOK, &HealthResult{Status: "ok", Checks: checks})
+}
+
+func writeHealth(w http.ResponseWriter, status int, result *HealthResult) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
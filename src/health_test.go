@@ -0,0 +1,144 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBridge(running, playerRunning bool) *bridge {
+	p := &player{}
+	p.setRunning(playerRunning)
+	b := &bridge{player: p, running: running}
+	b.cond = sync.NewCond(b.mu.RLocker())
+	return b
+}
+
+func TestHealthz(t *testing.T) {
+	h := &health{bridge: newTestBridge(false, false), audio: &audioWriter{}}
+	w := httptest.NewRecorder()
+	h.healthz(w)
+	if w.Code != http.StatusOK || w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("%d: %s", w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	var tests = []struct {
+		running       bool
+		audio         *audioWriter
+		playerRunning bool
+		status        int
+		result        HealthResult
+	}{
+		{true, &audioWriter{open: true}, true, http.StatusOK, HealthResult{
+			Status: "ok",
+			Checks: map[string]string{"session": "ok", "audio": "ok", "player": "ok"},
+		}},
+		{false, &audioWriter{open: true}, true, http.StatusServiceUnavailable, HealthResult{
+			Status: "unavailable",
+			Checks: map[string]string{"session": "not logged in", "audio": "ok", "player": "ok"},
+		}},
+		{true, &audioWriter{}, true, http.StatusServiceUnavailable, HealthResult{
+			Status: "unavailable",
+			Checks: map[string]string{"session": "ok", "audio": "audio stream closed", "player": "ok"},
+		}},
+		{true, &audioWriter{open: true, streamErr: errors.New("no device")}, false, http.StatusServiceUnavailable, HealthResult{
+			Status: "unavailable",
+			Checks: map[string]string{"session": "ok", "audio": "no device", "player": "not running"},
+		}},
+	}
+	for i, test := range tests {
+		h := &health{bridge: newTestBridge(test.running, test.playerRunning), audio: test.audio}
+		w := httptest.NewRecorder()
+		h.readyz(w)
+		if w.Code != test.status {
+			t.Errorf("%d: status %d != %d", i, w.Code, test.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%d: content type: %s", i, ct)
+		}
+		var result HealthResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Errorf("%d: %s", i, err)
+		} else if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%d: %+v != %+v", i, result, test.result)
+		}
+	}
+}
+
+func TestHealthAlive(t *testing.T) {
+	var tests = []struct {
+		processed     time.Duration
+		playerRunning bool
+		alive         bool
+	}{
+		{0, true, true},
+		{time.Second, true, false},
+		{0, false, false},
+	}
+	for i, test := range tests {
+		h := &health{bridge: newTestBridge(true, test.playerRunning)}
+		atomic.StoreInt64(&h.bridge.processed, time.Now().Add(-test.processed).UnixNano())
+		if alive := h.Alive(500 * time.Millisecond); alive != test.alive {
+			t.Errorf("%d: %v != %v", i, alive, test.alive)
+		}
+	}
+
+	// Session events never processed.
+	h := &health{bridge: newTestBridge(true, true)}
+	if h.Alive(time.Minute) {
+		t.Error("expected not alive before processing events")
+	}
+}
+
+func TestSyncTimeout(t *testing.T) {
+	b := newTestBridge(false, true)
+	b.SetSyncTimeout(20 * time.Millisecond)
+	start := time.Now()
+	err := b.sync()
+	if err == nil || err.StatusCode() != http.StatusServiceUnavailable || err.Code != "unavailable" {
+		t.Fatalf("expected unavailable error: %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond || d > time.Second {
+		t.Errorf("waited %s", d)
+	}
+
+	// The session becoming available releases waiting requests.
+	b.SetSyncTimeout(0)
+	done := make(chan *apiError)
+	go func() { done <- b.sync() }()
+	time.Sleep(10 * time.Millisecond)
+	b.thaw()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sync not released")
+	}
+	if err := b.sync(); err != nil {
+		t.Errorf("unexpected error while running: %v", err)
+	}
+}
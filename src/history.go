@@ -0,0 +1,198 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/martini-contrib/encoder"
+)
+
+const (
+	// searchHistorySize is the number of searches remembered per user.
+	searchHistorySize = 50
+
+	// searchURIPrefix is the prefix of search URIs, followed by the query.
+	searchURIPrefix = "spotify:search:"
+)
+
+// searchURI returns the URI of a search for the query, which can be loaded as
+// a play context.
+func searchURI(query string) string {
+	return searchURIPrefix + url.QueryEscape(query)
+}
+
+// searchQuery returns the query of a search URI.
+func searchQuery(uri string) (string, error) {
+	if !strings.HasPrefix(uri, searchURIPrefix) {
+		return "", errors.New("not a search: " + uri)
+	}
+	return url.QueryUnescape(strings.TrimPrefix(uri, searchURIPrefix))
+}
+
+// userSearches are the searches of one user.
+type userSearches struct {
+	History []*HistoryEntry `json:"history"`
+	Saved   []*SavedSearch  `json:"saved"`
+}
+
+// searchHistory keeps the latest and the saved searches per user, where users
+// are told apart by the token they authenticate with. It is written to a
+// file on every change.
+type searchHistory struct {
+	path string
+
+	mu    sync.Mutex
+	users map[string]*userSearches
+}
+
+// newSearchHistory reads the searches from the file, if it exists.
+func newSearchHistory(path string) *searchHistory {
+	h := &searchHistory{path: path, users: make(map[string]*userSearches)}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &h.users)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Failed to read search history: %s", err)
+	}
+	return h
+}
+
+func (h *searchHistory) user(identity string) *userSearches {
+	u, ok := h.users[identity]
+	if !ok {
+		u = &userSearches{History: []*HistoryEntry{}, Saved: []*SavedSearch{}}
+		h.users[identity] = u
+	}
+	return u
+}
+
+// write saves all searches, replacing the file once fully written.
+func (h *searchHistory) write() {
+	data, err := json.MarshalIndent(h.users, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(h.path), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(h.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(h.path+".tmp", h.path)
+	}
+	if err != nil {
+		log.Error("Failed to write search history: %s", err)
+	}
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// Add puts the search first in the history of the user, dropping any earlier
+// search for the same query. Nothing is written if it already is first.
+func (h *searchHistory) Add(identity, query, uri string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.user(identity)
+	if len(u.History) > 0 && u.History[0].Query == query {
+		return
+	}
+	history := []*HistoryEntry{{Query: query, URI: uri, Time: timestamp()}}
+	for _, e := range u.History {
+		if e.Query != query && len(history) < searchHistorySize {
+			history = append(history, e)
+		}
+	}
+	u.History = history
+	h.write()
+}
+
+func (h *searchHistory) list(enc encoder.Encoder, info *requestInfo) (int, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := &HistoryResult{History: h.user(info.identity).History}
+	return http.StatusOK, encoder.Must(enc.Encode(r))
+}
+
+func (h *searchHistory) clear(info *requestInfo) (int, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.user(info.identity).History = []*HistoryEntry{}
+	h.write()
+	return http.StatusNoContent, nil
+}
+
+func (h *searchHistory) saved(enc encoder.Encoder, info *requestInfo) (int, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := &SavedSearchesResult{Saved: h.user(info.identity).Saved}
+	return http.StatusOK, encoder.Must(enc.Encode(r))
+}
+
+type saveSearchArgs struct {
+	Name  string `form:"name" json:"name" binding:"required"`
+	Query string `form:"query" json:"query" binding:"required"`
+}
+
+// save saves the search, replacing any search with the same name.
+func (h *searchHistory) save(enc encoder.Encoder, args saveSearchArgs, info *requestInfo) (int, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.user(info.identity)
+	s := &SavedSearch{
+		ID:    randomID(),
+		Name:  args.Name,
+		Query: args.Query,
+		URI:   searchURI(args.Query),
+		Time:  timestamp(),
+	}
+	saved := []*SavedSearch{}
+	for _, e := range u.Saved {
+		if e.Name == s.Name {
+			s.ID = e.ID
+		} else {
+			saved = append(saved, e)
+		}
+	}
+	u.Saved = append(saved, s)
+	h.write()
+	return http.StatusCreated, encoder.Must(enc.Encode(s))
+}
+
+func (h *searchHistory) remove(enc encoder.Encoder, params martini.Params, info *requestInfo) (int, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.user(info.identity)
+	for i, e := range u.Saved {
+		if e.ID == params["id"] {
+			u.Saved = append(u.Saved[:i], u.Saved[i+1:]...)
+			h.write()
+			return http.StatusNoContent, nil
+		}
+	}
+	e := newNotFoundError("no saved search: " + params["id"])
+	return e.StatusCode(), encoder.Must(enc.Encode(e.Data()))
+}
@@ -0,0 +1,155 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/codegangsta/martini"
+	"github.com/martini-contrib/encoder"
+)
+
+func TestSearchURI(t *testing.T) {
+	var tests = []struct {
+		query string
+		uri   string
+	}{
+		{"daft punk", "spotify:search:daft+punk"},
+		{"artist:\"daft punk\" year:2001", "spotify:search:artist%3A%22daft+punk%22+year%3A2001"},
+		{"a+b&c=d", "spotify:search:a%2Bb%26c%3Dd"},
+		{"åäö", "spotify:search:%C3%A5%C3%A4%C3%B6"},
+		{"", "spotify:search:"},
+	}
+	for _, test := range tests {
+		uri := searchURI(test.query)
+		if uri != test.uri {
+			t.Errorf("%q: %s != %s", test.query, uri, test.uri)
+		}
+		query, err := searchQuery(uri)
+		if err != nil {
+			t.Errorf("%q: %s", test.query, err)
+		} else if query != test.query {
+			t.Errorf("%s: %q != %q", uri, query, test.query)
+		}
+	}
+
+	for _, uri := range []string{"spotify:track:abc", "search:daft", "spotify:search:%zz"} {
+		if _, err := searchQuery(uri); err == nil {
+			t.Errorf("%s: expected error", uri)
+		}
+	}
+}
+
+func savedNames(saved []*SavedSearch) []string {
+	names := []string{}
+	for _, s := range saved {
+		names = append(names, s.Name+"="+s.Query)
+	}
+	return names
+}
+
+func TestSearchHistorySaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h := newSearchHistory(path)
+	enc := encoder.JsonEncoder{}
+	alice := &requestInfo{identity: "token:alice"}
+	bob := &requestInfo{identity: "token:bob"}
+
+	save := func(info *requestInfo, name, query string) {
+		if status, _ := h.save(enc, saveSearchArgs{Name: name, Query: query}, info); status != http.StatusCreated {
+			t.Fatalf("save %s: %d", name, status)
+		}
+	}
+	save(alice, "daft", "daft punk")
+	save(alice, "air", "air")
+	save(bob, "daft", "daft")
+	id := h.users[alice.identity].Saved[0].ID
+
+	// Saving under the same name replaces the search, keeping its id.
+	save(alice, "daft", "daft punk year:2001")
+	saved := h.users[alice.identity].Saved
+	if names := savedNames(saved); !reflect.DeepEqual(names, []string{"air=air", "daft=daft punk year:2001"}) {
+		t.Errorf("saved: %v", names)
+	}
+	if saved[1].ID != id || saved[1].URI != searchURI("daft punk year:2001") {
+		t.Errorf("replaced: %+v", saved[1])
+	}
+
+	// Removing only applies to the searches of the user.
+	params := martini.Params{"id": id}
+	if status, _ := h.remove(enc, params, bob); status != http.StatusNotFound {
+		t.Errorf("remove of other user: %d", status)
+	}
+	if status, _ := h.remove(enc, params, alice); status != http.StatusNoContent {
+		t.Errorf("remove: %d", status)
+	}
+	if status, _ := h.remove(enc, params, alice); status != http.StatusNotFound {
+		t.Errorf("remove again: %d", status)
+	}
+
+	// The searches are read back from the file.
+	h = newSearchHistory(path)
+	if names := savedNames(h.users[alice.identity].Saved); !reflect.DeepEqual(names, []string{"air=air"}) {
+		t.Errorf("alice: %v", names)
+	}
+	if names := savedNames(h.users[bob.identity].Saved); !reflect.DeepEqual(names, []string{"daft=daft"}) {
+		t.Errorf("bob: %v", names)
+	}
+}
+
+func TestSearchHistoryAdd(t *testing.T) {
+	h := newSearchHistory(filepath.Join(t.TempDir(), "history.json"))
+	for _, q := range []string{"a", "b", "a", "c"} {
+		h.Add("token:alice", q, searchURI(q))
+	}
+	for i := 0; i < searchHistorySize+5; i++ {
+		h.Add("token:bob", string(rune('A'+i)), "")
+	}
+
+	var queries []string
+	for _, e := range h.users["token:alice"].History {
+		queries = append(queries, e.Query)
+	}
+	if !reflect.DeepEqual(queries, []string{"c", "a", "b"}) {
+		t.Errorf("latest first without duplicates: %v", queries)
+	}
+	if n := len(h.users["token:bob"].History); n != searchHistorySize {
+		t.Errorf("history size: %d", n)
+	}
+
+	// Repeating the latest search leaves the history as is.
+	if err := os.Remove(h.path); err != nil {
+		t.Fatal(err)
+	}
+	latest := h.users["token:alice"].History[0]
+	h.Add("token:alice", "c", searchURI("c"))
+	if h.users["token:alice"].History[0] != latest {
+		t.Error("latest search replaced")
+	}
+	if _, err := os.Stat(h.path); !os.IsNotExist(err) {
+		t.Errorf("history written: %v", err)
+	}
+
+	if status, _ := h.clear(&requestInfo{identity: "token:alice"}); status != http.StatusNoContent {
+		t.Errorf("clear: %d", status)
+	}
+	if len(h.users["token:alice"].History) != 0 || len(h.users["token:bob"].History) == 0 {
+		t.Error("expected only the history of alice to be cleared")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// loadWorkers is the number of objects waited for at the same time.
+	loadWorkers = 8
+
+	// loadTimeout is how long to wait for the metadata of a response. Objects
+	// not loaded by then are returned flagged as not loaded.
+	loadTimeout = 5 * time.Second
+)
+
+// loadable is a libspotify object whose metadata is loaded asynchronously.
+type loadable interface {
+	Wait()
+	IsLoaded() bool
+}
+
+// loadAll waits for the objects to load, at most loadWorkers at a time, until
+// they are all loaded or the timeout expires. It reports the number of objects
+// which were not loaded in time.
+//
+// A wait can not be cancelled, so workers busy at the timeout finish their
+// current object in the background before exiting.
+func loadAll(kind string, objects []loadable, timeout time.Duration) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	jobs := make(chan loadable)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < loadWorkers && i < len(objects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range jobs {
+				o.Wait()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	expired := false
+feed:
+	for _, o := range objects {
+		if o.IsLoaded() {
+			continue
+		}
+		select {
+		case jobs <- o:
+		case <-timer.C:
+			expired = true
+			break feed
+		}
+	}
+	close(jobs)
+	if !expired {
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+	}
+
+	missing := 0
+	for _, o := range objects {
+		if !o.IsLoaded() {
+			missing++
+		}
+	}
+	if missing > 0 {
+		log.Info("%d of %d objects not loaded in time for %s", missing, len(objects), kind)
+		loadIncomplete.WithLabelValues(kind).Inc()
+	}
+	return missing
+}
+
+// waitTimeout calls wait until it returns or the timeout expires, and reports
+// if it returned in time. As for loadAll, a wait which is still busy at the
+// timeout finishes in the background.
+func waitTimeout(wait func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// waitLoaded waits for what is described to load until the load timeout, and
+// returns an unavailable error if it did not load in time.
+func waitLoaded(what string, wait func()) *apiError {
+	if !waitTimeout(wait, loadTimeout) {
+		log.Info("Timed out loading %s", what)
+		return newUnavailableError(what + " not loaded in time")
+	}
+	return nil
+}
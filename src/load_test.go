@@ -0,0 +1,135 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLoadable is loaded after a delay once waited for, or never if the delay
+// is negative.
+type fakeLoadable struct {
+	delay  time.Duration
+	loaded int32
+	waited int32
+
+	// active counts the objects being waited for at the same time.
+	active    *int32
+	maxActive *int32
+	mu        *sync.Mutex
+}
+
+func (f *fakeLoadable) Wait() {
+	atomic.StoreInt32(&f.waited, 1)
+	n := atomic.AddInt32(f.active, 1)
+	defer atomic.AddInt32(f.active, -1)
+	f.mu.Lock()
+	if n > *f.maxActive {
+		*f.maxActive = n
+	}
+	f.mu.Unlock()
+
+	if f.delay < 0 {
+		time.Sleep(50 * time.Millisecond)
+		return
+	}
+	time.Sleep(f.delay)
+	atomic.StoreInt32(&f.loaded, 1)
+}
+
+func (f *fakeLoadable) IsLoaded() bool {
+	return atomic.LoadInt32(&f.loaded) == 1
+}
+
+func TestLoadAll(t *testing.T) {
+	const ms = time.Millisecond
+	var tests = []struct {
+		delays  []time.Duration
+		loaded  []bool
+		timeout time.Duration
+		missing int
+	}{
+		{nil, nil, 10 * ms, 0},
+		{[]time.Duration{ms, ms, ms}, nil, time.Second, 0},
+		{[]time.Duration{0, 0}, []bool{true, true}, 10 * ms, 0},
+		{[]time.Duration{ms, -1, ms, -1}, nil, 20 * ms, 2},
+		{[]time.Duration{-1, time.Second}, []bool{false, true}, 20 * ms, 1},
+	}
+	for i, test := range tests {
+		var active, maxActive int32
+		var mu sync.Mutex
+		var objects []loadable
+		var preloaded []*fakeLoadable
+		for j, delay := range test.delays {
+			f := &fakeLoadable{delay: delay, active: &active, maxActive: &maxActive, mu: &mu}
+			if test.loaded != nil && test.loaded[j] {
+				f.loaded = 1
+				preloaded = append(preloaded, f)
+			}
+			objects = append(objects, f)
+		}
+		start := time.Now()
+		if missing := loadAll("test", objects, test.timeout); missing != test.missing {
+			t.Errorf("%d: missing %d != %d", i, missing, test.missing)
+		}
+		if d := time.Since(start); d > test.timeout+100*ms {
+			t.Errorf("%d: timeout not respected: %s", i, d)
+		}
+		for _, f := range preloaded {
+			if atomic.LoadInt32(&f.waited) != 0 {
+				t.Errorf("%d: expected loaded objects not to be waited for", i)
+			}
+		}
+	}
+}
+
+func TestLoadAllWorkers(t *testing.T) {
+	var active, maxActive int32
+	var mu sync.Mutex
+	var objects []loadable
+	for i := 0; i < loadWorkers*3; i++ {
+		objects = append(objects, &fakeLoadable{delay: 5 * time.Millisecond, active: &active, maxActive: &maxActive, mu: &mu})
+	}
+	if missing := loadAll("test", objects, time.Second); missing != 0 {
+		t.Errorf("missing %d", missing)
+	}
+	if maxActive > loadWorkers {
+		t.Errorf("%d objects waited for at once, expected at most %d", maxActive, loadWorkers)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	var tests = []struct {
+		delay time.Duration
+		ok    bool
+	}{
+		{0, true},
+		{time.Millisecond, true},
+		{time.Second, false},
+	}
+	for _, test := range tests {
+		start := time.Now()
+		ok := waitTimeout(func() { time.Sleep(test.delay) }, 50*time.Millisecond)
+		if ok != test.ok {
+			t.Errorf("%s: %v != %v", test.delay, ok, test.ok)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("%s: timeout not respected: %s", test.delay, d)
+		}
+	}
+}
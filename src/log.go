@@ -0,0 +1,370 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/martini-contrib/encoder"
+	"github.com/op/go-logging"
+)
+
+const (
+	// textLogFormat is the format of the log unless JSON is requested.
+	textLogFormat = "%{time:2006-01-02T15:04:05.000} %{level:.4s} %{module} %{message}"
+
+	// logHistorySize is the number of log entries kept for the log API.
+	logHistorySize = 1000
+)
+
+var (
+	// defaultLogFile is where the log is written unless a file is configured.
+	// The terminal interface needs the terminal for itself, and sets this.
+	defaultLogFile string
+
+	// logFile is the file currently written to, if any.
+	logFile *rotatingFile
+
+	// recentLogs holds the latest log entries, served by the log API.
+	recentLogs = newLogHistory(logHistorySize)
+)
+
+// setupLogging configures the log output, format and levels. It can be called
+// again to apply a reloaded configuration.
+func setupLogging(cfg *config) error {
+	var out io.Writer = os.Stderr
+	path := cfg.LogFile
+	if path == "" {
+		path = defaultLogFile
+	}
+	old := logFile
+	if path != "" {
+		maxSize := int64(cfg.LogMaxSize) * 1024 * 1024
+		if old != nil && old.path == path {
+			old.SetLimits(maxSize, cfg.LogMaxFiles)
+			old = nil
+		} else {
+			f, err := openRotatingFile(path, maxSize, cfg.LogMaxFiles)
+			if err != nil {
+				return err
+			}
+			logFile = f
+		}
+		out = logFile
+	} else {
+		logFile = nil
+	}
+
+	logBackend := logging.NewLogBackend(out, "", 0)
+	var backend logging.Backend
+	if cfg.LogFormat == "json" {
+		backend = logging.NewBackendFormatter(logBackend, jsonFormatter{})
+	} else {
+		logBackend.Color = cfg.Color && out == os.Stderr
+		backend = logging.NewBackendFormatter(logBackend, logging.MustStringFormatter(textLogFormat))
+	}
+
+	// The levels have been verified when validating the configuration.
+	levels := newModuleLevels(logging.MultiLogger(backend, recentLogs))
+	if level, err := logging.LogLevel(cfg.LogLevel); err == nil {
+		levels.SetLevel(level, "")
+	}
+	for module, name := range cfg.LogLevels {
+		if level, err := logging.LogLevel(name); err == nil {
+			levels.SetLevel(level, module)
+		}
+	}
+	logging.SetBackend(levels)
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// moduleLevels filters log records by the level of their module. Modules are
+// separated by dots, eg. libspotify.ap, and a module without a level of its
+// own uses the level of its parent. The root module is the empty string.
+type moduleLevels struct {
+	backend logging.Backend
+
+	mu     sync.RWMutex
+	levels map[string]logging.Level
+}
+
+func newModuleLevels(backend logging.Backend) *moduleLevels {
+	return &moduleLevels{
+		backend: backend,
+		levels:  map[string]logging.Level{"": logging.DEBUG},
+	}
+}
+
+// GetLevel returns the level in effect for the module.
+func (l *moduleLevels) GetLevel(module string) logging.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for {
+		if level, ok := l.levels[module]; ok {
+			return level
+		}
+		if i := strings.LastIndex(module, "."); i >= 0 {
+			module = module[:i]
+		} else {
+			module = ""
+		}
+	}
+}
+
+// SetLevel sets the level of the module and any of its sub modules which do
+// not have a level of their own.
+func (l *moduleLevels) SetLevel(level logging.Level, module string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.levels[module] = level
+}
+
+// IsEnabledFor reports if messages of the level are logged for the module.
+func (l *moduleLevels) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= l.GetLevel(module)
+}
+
+// Log passes the record on unless it is filtered out by its level.
+func (l *moduleLevels) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	if !l.IsEnabledFor(level, rec.Module) {
+		return nil
+	}
+	return l.backend.Log(level, calldepth+1, rec)
+}
+
+// levelName returns the name of the level as used in the API and the
+// configuration.
+func levelName(level logging.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// jsonFormatter formats each record as a JSON object.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	data, err := json.Marshal(&struct {
+		Time    string `json:"time"`
+		Level   string `json:"level"`
+		Module  string `json:"module"`
+		Message string `json:"message"`
+	}{
+		Time:    r.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Level:   levelName(r.Level),
+		Module:  r.Module,
+		Message: r.Message(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// rotatingFile is a log file which is rotated when it grows too large. The
+// previous files are kept as path.1, path.2 and so on, where the highest
+// number is the oldest.
+type rotatingFile struct {
+	path string
+
+	mu       sync.Mutex
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// openRotatingFile opens the file for appending. A maxSize of zero disables
+// rotation, and maxFiles is the number of rotated files to keep.
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// SetLimits changes when the file is rotated and how many files are kept.
+func (r *rotatingFile) SetLimits(maxSize int64, maxFiles int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxSize, r.maxFiles = maxSize, maxFiles
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the previous files one step, dropping the oldest, and starts
+// on a new file.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	if r.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Close closes the file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// logHistory keeps the latest log entries in a ring buffer.
+type logHistory struct {
+	mu      sync.Mutex
+	entries []*LogEntry
+	next    int
+	full    bool
+}
+
+func newLogHistory(size int) *logHistory {
+	return &logHistory{entries: make([]*LogEntry, size)}
+}
+
+// Log adds the record to the history, replacing the oldest entry when full.
+func (h *logHistory) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	entry := &LogEntry{
+		ID:      rec.Id,
+		Time:    rec.Time.Unix(),
+		Level:   levelName(level),
+		Module:  rec.Module,
+		Message: rec.Message(),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+	return nil
+}
+
+// Entries returns at most limit of the latest entries after the entry with
+// the id since, which are of at least the level and belong to the module or
+// any of its sub modules. The entries are returned oldest first.
+func (h *logHistory) Entries(since uint64, level logging.Level, module string, limit int) []*LogEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ordered := h.entries[:h.next]
+	if h.full {
+		ordered = append(append([]*LogEntry{}, h.entries[h.next:]...), ordered...)
+	}
+
+	entries := []*LogEntry{}
+	for i := len(ordered) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := ordered[i]
+		if e.ID <= since {
+			break
+		}
+		if module != "" && e.Module != module && !strings.HasPrefix(e.Module, module+".") {
+			continue
+		}
+		if l, err := logging.LogLevel(e.Level); err == nil && l > level {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+type logArgs struct {
+	Since  int    `form:"since" json:"since"`
+	Level  string `form:"level" json:"level"`
+	Module string `form:"module" json:"module"`
+	Limit  int    `form:"limit" json:"limit"`
+}
+
+func (h *logHistory) serve(enc encoder.Encoder, args logArgs) (int, []byte) {
+	level := logging.DEBUG
+	if args.Level != "" {
+		var err error
+		if level, err = logging.LogLevel(args.Level); err != nil {
+			e := newBadRequestError("invalid level: " + args.Level)
+			return e.StatusCode(), encoder.Must(enc.Encode(e.Data()))
+		}
+	}
+	if args.Since < 0 || args.Limit < 0 {
+		e := newBadRequestError("since and limit must not be negative")
+		return e.StatusCode(), encoder.Must(enc.Encode(e.Data()))
+	}
+	limit := args.Limit
+	if limit == 0 || limit > logHistorySize {
+		limit = logHistorySize
+	}
+	entries := h.Entries(uint64(args.Since), level, args.Module, limit)
+	return http.StatusOK, encoder.Must(enc.Encode(&LogResult{Entries: entries}))
+}
@@ -0,0 +1,188 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func TestModuleLevels(t *testing.T) {
+	l := newModuleLevels(nil)
+	l.SetLevel(logging.WARNING, "")
+	l.SetLevel(logging.DEBUG, "libspotify")
+	l.SetLevel(logging.ERROR, "libspotify.ap")
+
+	var tests = []struct {
+		module string
+		level  logging.Level
+	}{
+		{"", logging.WARNING},
+		{"sith", logging.WARNING},
+		{"libspotify", logging.DEBUG},
+		{"libspotify.cache", logging.DEBUG},
+		{"libspotify.ap", logging.ERROR},
+		{"libspotify.ap.conn", logging.ERROR},
+		{"libspotifyx", logging.WARNING},
+		{"mpd.libspotify", logging.WARNING},
+	}
+	for _, test := range tests {
+		if level := l.GetLevel(test.module); level != test.level {
+			t.Errorf("%q: %s != %s", test.module, level, test.level)
+		}
+	}
+
+	if !l.IsEnabledFor(logging.ERROR, "libspotify.ap") || l.IsEnabledFor(logging.WARNING, "libspotify.ap") {
+		t.Error("expected only errors and above for libspotify.ap")
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	var tests = []struct {
+		maxFiles int
+		files    map[string]string
+	}{
+		// The highest number is the oldest, and files beyond the limit
+		// are dropped.
+		{2, map[string]string{"sith.log": "4444", "sith.log.1": "3333", "sith.log.2": "2222"}},
+		{1, map[string]string{"sith.log": "4444", "sith.log.1": "3333"}},
+		{0, map[string]string{"sith.log": "4444"}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "logs", "sith.log")
+		r, err := openRotatingFile(path, 4, test.maxFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 4; i++ {
+			if _, err := fmt.Fprintf(r, "%d%d", i, i); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fmt.Fprintf(r, "%d%d", i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := filepath.Glob(filepath.Join(dir, "logs", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]string)
+		for _, name := range names {
+			files[filepath.Base(name)] = readFile(t, name)
+		}
+		if !reflect.DeepEqual(files, test.files) {
+			t.Errorf("%d: %v != %v", test.maxFiles, files, test.files)
+		}
+	}
+}
+
+func TestRotatingFileAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sith.log")
+	if err := os.WriteFile(path, []byte("12345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The size of an existing file counts towards the limit.
+	r, err := openRotatingFile(path, 6, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Write([]byte("67")); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, path+".1"); s != "12345" {
+		t.Errorf("rotated: %q", s)
+	}
+
+	// Writes larger than the limit are never split.
+	r.SetLimits(0, 1)
+	if _, err := r.Write([]byte("89abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, path); s != "6789abcdef" {
+		t.Errorf("current: %q", s)
+	}
+}
+
+func TestLogHistory(t *testing.T) {
+	h := newLogHistory(5)
+	records := []struct {
+		module string
+		level  logging.Level
+	}{
+		{"sith", logging.INFO},
+		{"mpd", logging.DEBUG},
+		{"libspotify", logging.ERROR},
+		{"libspotify.ap", logging.WARNING},
+		{"sith", logging.DEBUG},
+		{"libspotify.cache", logging.INFO},
+		{"libspotifyx", logging.ERROR},
+	}
+	for i, r := range records {
+		rec := &logging.Record{Id: uint64(i + 1), Time: time.Now(), Module: r.module, Level: r.level}
+		if err := h.Log(r.level, 0, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		since  uint64
+		level  logging.Level
+		module string
+		limit  int
+		ids    []uint64
+	}{
+		// Only the latest 5 entries are kept, returned oldest first.
+		{0, logging.DEBUG, "", 10, []uint64{3, 4, 5, 6, 7}},
+		{5, logging.DEBUG, "", 10, []uint64{6, 7}},
+		{7, logging.DEBUG, "", 10, []uint64{}},
+		{0, logging.DEBUG, "", 2, []uint64{6, 7}},
+		{0, logging.WARNING, "", 10, []uint64{3, 4, 7}},
+		{0, logging.DEBUG, "libspotify", 10, []uint64{3, 4, 6}},
+		{0, logging.INFO, "libspotify", 10, []uint64{3, 4, 6}},
+		{0, logging.WARNING, "libspotify", 1, []uint64{4}},
+		{0, logging.DEBUG, "libspotify.ap", 10, []uint64{4}},
+		{0, logging.DEBUG, "mpd", 10, []uint64{}},
+	}
+	for _, test := range tests {
+		ids := []uint64{}
+		for _, e := range h.Entries(test.since, test.level, test.module, test.limit) {
+			ids = append(ids, e.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%d/%s/%q/%d: %v != %v", test.since, test.level, test.module, test.limit, ids, test.ids)
+		}
+	}
+}
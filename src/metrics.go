@@ -0,0 +1,149 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exported at /metrics.
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sith",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sith",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latencies by route and method, except for streams.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	loadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sith",
+		Name:      "load_duration_seconds",
+		Help:      "Time to search or load playlists, including their metadata.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"kind"})
+
+	loadIncomplete = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sith",
+		Name:      "load_incomplete_total",
+		Help:      "Responses returned before all their metadata was loaded.",
+	}, []string{"kind"})
+
+	searchCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sith",
+		Name:      "search_cache_lookups_total",
+		Help:      "Lookups in the search cache, by result: hit or miss.",
+	}, []string{"result"})
+
+	audioDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sith",
+		Name:      "audio_dropped_deliveries_total",
+		Help:      "Audio deliveries refused since the audio buffer was full.",
+	})
+
+	tracksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sith",
+		Name:      "tracks_total",
+		Help:      "Tracks started, by result: played or failed.",
+	}, []string{"result"})
+
+	eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sith",
+		Name:      "events_total",
+		Help:      "Events sent, eg. streaming-error and play-token-lost.",
+	}, []string{"event"})
+
+	sseSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sith",
+		Name:      "sse_subscribers",
+		Help:      "Clients connected to the server sent events stream.",
+	})
+
+	connectionState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sith",
+		Name:      "connection_state",
+		Help:      "The connection state of the session, 1 for the current state.",
+	}, []string{"state"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpDuration,
+		loadDuration,
+		loadIncomplete,
+		searchCacheLookups,
+		audioDropped,
+		tracksTotal,
+		eventsTotal,
+		sseSubscribers,
+		connectionState,
+	)
+}
+
+// registerAudioMetrics exports the fill level of the audio buffer.
+func registerAudioMetrics(w *audioWriter) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "sith",
+		Name:      "audio_buffer_fill_ratio",
+		Help:      "How full the audio buffer is, from 0 to 1.",
+	}, func() float64 {
+		return float64(len(w.input)) / float64(cap(w.input))
+	}))
+}
+
+// setConnectionState marks state as the current connection state.
+func setConnectionState(state string) {
+	for _, s := range connectionStates {
+		v := 0.
+		if s == state {
+			v = 1
+		}
+		connectionState.WithLabelValues(s).Set(v)
+	}
+}
+
+// observeLoad records the time spent loading since start.
+func observeLoad(kind string, start time.Time) {
+	loadDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+// routeMetrics counts and times the requests to the route.
+func routeMetrics(r *route) martini.Handler {
+	streaming := r.produces == "text/event-stream" || r.status == http.StatusSwitchingProtocols
+	return func(c martini.Context, w http.ResponseWriter) {
+		start := time.Now()
+		c.Next()
+
+		status := http.StatusOK
+		if rw, ok := w.(martini.ResponseWriter); ok && rw.Status() != 0 {
+			status = rw.Status()
+		}
+		httpRequests.WithLabelValues(r.id, r.method, strconv.Itoa(status)).Inc()
+		if !streaming {
+			httpDuration.WithLabelValues(r.id, r.method).Observe(time.Since(start).Seconds())
+		}
+	}
+}
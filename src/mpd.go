@@ -0,0 +1,702 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// mpdVersion is the version of the MPD protocol announced to clients.
+const mpdVersion = "0.19.0"
+
+// mpdSearchLimit is the number of tracks returned when searching.
+const mpdSearchLimit = 50
+
+// Error codes of the MPD protocol.
+const (
+	mpdErrorArg        = 2
+	mpdErrorPassword   = 3
+	mpdErrorPermission = 4
+	mpdErrorUnknown    = 5
+	mpdErrorNoExist    = 50
+	mpdErrorSystem     = 52
+)
+
+// mpdError is a failed command, reported to the client as an ACK.
+type mpdError struct {
+	code    int
+	message string
+}
+
+func (e *mpdError) Error() string {
+	return e.message
+}
+
+func newMPDError(code int, format string, args ...interface{}) *mpdError {
+	return &mpdError{code, fmt.Sprintf(format, args...)}
+}
+
+// mpdServer lets MPD clients control the player. The MPD playlist is the
+// playing track followed by the queued tracks, which are consumed as they are
+// played. Songs keep the id they were given when queued or loaded.
+//
+// When tokens are configured, clients must pass one of them with the password
+// command before anything but the commands in mpdPublicCommands is allowed.
+type mpdServer struct {
+	bridge *bridge
+	audio  *audioWriter
+	auth   *auth
+
+	mu      sync.Mutex
+	version int
+	idlers  map[chan string]bool
+}
+
+// mpdCommands maps the supported commands to their implementation.
+var mpdCommands map[string]func(*mpdConn, []string) error
+
+func init() {
+	mpdCommands = map[string]func(*mpdConn, []string) error{
+		"add":           (*mpdConn).add,
+		"addid":         (*mpdConn).addID,
+		"close":         nil,
+		"commands":      (*mpdConn).commands,
+		"currentsong":   (*mpdConn).currentSong,
+		"listplaylists": (*mpdConn).listPlaylists,
+		"next":          (*mpdConn).next,
+		"notcommands":   (*mpdConn).notCommands,
+		"pause":         (*mpdConn).pause,
+		"password":      (*mpdConn).password,
+		"ping":          (*mpdConn).ping,
+		"play":          (*mpdConn).play,
+		"playid":        (*mpdConn).playID,
+		"playlistinfo":  (*mpdConn).playlistInfo,
+		"plchanges":     (*mpdConn).playlistInfo,
+		"previous":      (*mpdConn).previous,
+		"search":        (*mpdConn).search,
+		"setvol":        (*mpdConn).setVolume,
+		"status":        (*mpdConn).status,
+	}
+}
+
+// mpdPublicCommands are allowed without a password.
+var mpdPublicCommands = map[string]bool{
+	"close":       true,
+	"commands":    true,
+	"notcommands": true,
+	"password":    true,
+	"ping":        true,
+}
+
+func newMPDServer(bridge *bridge, audio *audioWriter, auth *auth, ew *EventsWriter) *mpdServer {
+	s := &mpdServer{
+		bridge: bridge,
+		audio:  audio,
+		auth:   auth,
+		idlers: make(map[chan string]bool),
+	}
+	filter := eventFilter{types: map[string]bool{}, level: logging.CRITICAL}
+	go ew.follow(filter, false, s.event)
+	return s
+}
+
+// ListenAndServe accepts MPD clients on the address.
+func (s *mpdServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Info("Starting up MPD interface at %s", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// event notifies idle clients of the changes the event implies.
+func (s *mpdServer) event(e Event) {
+	switch e.Type {
+	case "play-track":
+		s.changed("player", "playlist")
+	case "track-end", "play-token-lost", "play-track-failed", "player-state", "logged-in", "logged-out":
+		s.changed("player")
+	}
+}
+
+// changed notifies idle clients of changes to the subsystems.
+func (s *mpdServer) changed(subsystems ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, subsystem := range subsystems {
+		if subsystem == "playlist" {
+			s.version++
+		}
+		for idler := range s.idlers {
+			select {
+			case idler <- subsystem:
+			default:
+			}
+		}
+	}
+}
+
+func (s *mpdServer) playlistVersion() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// mpdConn is a connected MPD client.
+type mpdConn struct {
+	s     *mpdServer
+	w     *bufio.Writer
+	lines chan string
+
+	// token is the password given by the client, if any.
+	token string
+}
+
+func (s *mpdServer) serve(conn net.Conn) {
+	log.Debug("MPD client connected from %s", conn.RemoteAddr())
+
+	c := &mpdConn{s: s, w: bufio.NewWriter(conn), lines: make(chan string)}
+	go func() {
+		defer close(c.lines)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+	}()
+	// Drain the reader if the client is dropped before it disconnects.
+	defer func() {
+		conn.Close()
+		for range c.lines {
+		}
+	}()
+
+	fmt.Fprintf(c.w, "OK MPD %s\n", mpdVersion)
+	for c.w.Flush() == nil {
+		line, ok := <-c.lines
+		if !ok {
+			return
+		}
+		args, err := mpdArgs(line)
+		if err != nil {
+			c.ack(0, "", newMPDError(mpdErrorArg, "%s", err))
+			continue
+		} else if len(args) == 0 {
+			c.ack(0, "", newMPDError(mpdErrorUnknown, "No command given"))
+			continue
+		}
+
+		switch args[0] {
+		case "close":
+			return
+		case "idle":
+			if !c.permitted() {
+				c.ack(0, args[0], newMPDError(mpdErrorPermission, "you don't have permission for \"%s\"", args[0]))
+			} else if !c.idle(args[1:]) {
+				return
+			}
+		case "command_list_begin", "command_list_ok_begin":
+			if !c.commandList(args[0] == "command_list_ok_begin") {
+				return
+			}
+		default:
+			if err := c.exec(args); err != nil {
+				c.ack(0, args[0], err)
+			} else {
+				fmt.Fprint(c.w, "OK\n")
+			}
+		}
+	}
+}
+
+// exec runs a single command.
+func (c *mpdConn) exec(args []string) error {
+	command := mpdCommands[args[0]]
+	if command == nil {
+		return newMPDError(mpdErrorUnknown, "unknown command \"%s\"", args[0])
+	}
+	if !mpdPublicCommands[args[0]] && !c.permitted() {
+		return newMPDError(mpdErrorPermission, "you don't have permission for \"%s\"", args[0])
+	}
+	return command(c, args[1:])
+}
+
+// permitted reports if the client has given a valid password, or none is
+// required. The tokens are checked every time since they might be reloaded.
+func (c *mpdConn) permitted() bool {
+	return c.s.auth.Valid(c.token)
+}
+
+// ack reports the failed command.
+func (c *mpdConn) ack(index int, command string, err error) {
+	code := mpdErrorSystem
+	if e, ok := err.(*mpdError); ok {
+		code = e.code
+	}
+	fmt.Fprintf(c.w, "ACK [%d@%d] {%s} %s\n", code, index, command, err)
+}
+
+// commandList runs the commands up to command_list_end, stopping at the first
+// failing one. It returns false if the client disconnected.
+func (c *mpdConn) commandList(ok bool) bool {
+	var commands [][]string
+	var parseErr error
+	var ended bool
+	for line := range c.lines {
+		if line == "command_list_end" {
+			ended = true
+			break
+		}
+		args, err := mpdArgs(line)
+		if err != nil && parseErr == nil {
+			parseErr = err
+		}
+		commands = append(commands, args)
+	}
+	if !ended {
+		return false
+	} else if parseErr != nil {
+		c.ack(0, "", newMPDError(mpdErrorArg, "%s", parseErr))
+		return true
+	}
+
+	for i, args := range commands {
+		if len(args) == 0 || args[0] == "close" {
+			return false
+		}
+		if err := c.exec(args); err != nil {
+			c.ack(i, args[0], err)
+			return true
+		}
+		if ok {
+			fmt.Fprint(c.w, "list_OK\n")
+		}
+	}
+	fmt.Fprint(c.w, "OK\n")
+	return true
+}
+
+// idle waits until any of the subsystems change, or the client cancels with
+// noidle. It returns false if the client disconnected.
+func (c *mpdConn) idle(subsystems []string) bool {
+	wanted := make(map[string]bool)
+	for _, subsystem := range subsystems {
+		wanted[subsystem] = true
+	}
+
+	changes := make(chan string, 16)
+	c.s.mu.Lock()
+	c.s.idlers[changes] = true
+	c.s.mu.Unlock()
+	defer func() {
+		c.s.mu.Lock()
+		delete(c.s.idlers, changes)
+		c.s.mu.Unlock()
+	}()
+
+	changed := make(map[string]bool)
+	for len(changed) == 0 {
+		select {
+		case line, ok := <-c.lines:
+			// Anything but noidle while idle is a protocol error.
+			if !ok || line != "noidle" {
+				return false
+			}
+			fmt.Fprint(c.w, "OK\n")
+			return true
+		case subsystem := <-changes:
+			if len(wanted) == 0 || wanted[subsystem] {
+				changed[subsystem] = true
+			}
+		}
+	}
+
+	// Collect any other changes happening at the same time.
+	for drained := false; !drained; {
+		select {
+		case subsystem := <-changes:
+			if len(wanted) == 0 || wanted[subsystem] {
+				changed[subsystem] = true
+			}
+		default:
+			drained = true
+		}
+	}
+	var names []string
+	for subsystem := range changed {
+		names = append(names, subsystem)
+	}
+	sort.Strings(names)
+	for _, subsystem := range names {
+		fmt.Fprintf(c.w, "changed: %s\n", subsystem)
+	}
+	fmt.Fprint(c.w, "OK\n")
+	return true
+}
+
+// mpdSong is a song in the playlist.
+type mpdSong struct {
+	id    int
+	track *Track
+}
+
+// playlist returns the playing track followed by the queued tracks, and if the
+// first track is the playing one.
+func (c *mpdConn) playlist() ([]mpdSong, bool) {
+	queued, hasCurrent := c.s.bridge.player.Songs()
+	objects := make([]loadable, len(queued))
+	for i, q := range queued {
+		objects[i] = q.track
+	}
+	loadAll("mpd", objects, loadTimeout)
+
+	// Songs not loaded in time are listed without metadata.
+	var songs []mpdSong
+	for _, q := range queued {
+		songs = append(songs, mpdSong{q.id, newTrack(q.track)})
+	}
+	return songs, hasCurrent
+}
+
+// writeSong writes the song and its position and id in the playlist, if any.
+// Only the file is known of songs not loaded.
+func (c *mpdConn) writeSong(t *Track, pos, id int) {
+	fmt.Fprintf(c.w, "file: %s\n", t.URI)
+	if t.Loaded {
+		fmt.Fprintf(c.w, "Title: %s\n", t.Name)
+		for _, artist := range t.Artists {
+			fmt.Fprintf(c.w, "Artist: %s\n", artist.Name)
+		}
+		if t.Album != nil {
+			fmt.Fprintf(c.w, "Album: %s\n", t.Album.Name)
+		}
+		fmt.Fprintf(c.w, "Time: %d\n", int(t.Duration))
+		fmt.Fprintf(c.w, "duration: %.3f\n", t.Duration)
+	}
+	if pos >= 0 {
+		fmt.Fprintf(c.w, "Pos: %d\n", pos)
+		fmt.Fprintf(c.w, "Id: %d\n", id)
+	}
+}
+
+func (c *mpdConn) ping(args []string) error {
+	return nil
+}
+
+func (c *mpdConn) password(args []string) error {
+	if len(args) != 1 {
+		return newMPDError(mpdErrorArg, "wrong number of arguments")
+	}
+	if !c.s.auth.Valid(args[0]) {
+		return newMPDError(mpdErrorPassword, "incorrect password")
+	}
+	c.token = args[0]
+	return nil
+}
+
+// commands lists the commands the client may use.
+func (c *mpdConn) commands(args []string) error {
+	c.writeCommands(true)
+	return nil
+}
+
+// notCommands lists the commands the client may not use until it has given a
+// password.
+func (c *mpdConn) notCommands(args []string) error {
+	c.writeCommands(false)
+	return nil
+}
+
+func (c *mpdConn) writeCommands(permitted bool) {
+	all := c.permitted()
+	var names []string
+	for name := range mpdCommands {
+		if (all || mpdPublicCommands[name]) == permitted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.w, "command: %s\n", name)
+	}
+}
+
+func (c *mpdConn) status(args []string) error {
+	tracks, hasCurrent := c.playlist()
+	current, playing := c.s.bridge.player.Current()
+
+	state := "stop"
+	if playing {
+		state = "play"
+	} else if current.Track != nil {
+		state = "pause"
+	}
+	fmt.Fprintf(c.w, "volume: %d\n", c.s.audio.Volume())
+	fmt.Fprint(c.w, "repeat: 0\nrandom: 0\nsingle: 0\nconsume: 1\n")
+	fmt.Fprintf(c.w, "playlist: %d\n", c.s.playlistVersion())
+	fmt.Fprintf(c.w, "playlistlength: %d\n", len(tracks))
+	fmt.Fprintf(c.w, "state: %s\n", state)
+	if hasCurrent {
+		elapsed := c.s.bridge.player.Position().Seconds()
+		fmt.Fprintf(c.w, "song: 0\nsongid: %d\n", tracks[0].id)
+		fmt.Fprintf(c.w, "time: %d:%d\n", int(elapsed), int(tracks[0].track.Duration))
+		fmt.Fprintf(c.w, "elapsed: %.3f\n", elapsed)
+		fmt.Fprintf(c.w, "duration: %.3f\n", tracks[0].track.Duration)
+		if len(tracks) > 1 {
+			fmt.Fprintf(c.w, "nextsong: 1\nnextsongid: %d\n", tracks[1].id)
+		}
+	}
+	return nil
+}
+
+func (c *mpdConn) currentSong(args []string) error {
+	if tracks, hasCurrent := c.playlist(); hasCurrent {
+		c.writeSong(tracks[0].track, 0, tracks[0].id)
+	}
+	return nil
+}
+
+func (c *mpdConn) playlistInfo(args []string) error {
+	tracks, _ := c.playlist()
+	for i, t := range tracks {
+		c.writeSong(t.track, i, t.id)
+	}
+	return nil
+}
+
+func (c *mpdConn) play(args []string) error {
+	tracks, hasCurrent := c.playlist()
+	pos := 0
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return newMPDError(mpdErrorArg, "Integer expected: %s", args[0])
+		}
+		pos = n
+	}
+	if pos < 0 || (pos > 0 && pos >= len(tracks)) {
+		return newMPDError(mpdErrorNoExist, "Bad song index")
+	}
+
+	if err := c.s.bridge.sync(); err != nil {
+		return err
+	}
+	switch {
+	case hasCurrent && pos == 0:
+		c.s.bridge.player.Resume("")
+	case hasCurrent:
+		c.s.bridge.player.Skip(pos-1, "")
+	case len(tracks) > 0:
+		c.s.bridge.player.Skip(pos, "")
+	}
+	c.s.changed("player")
+	return nil
+}
+
+// playID plays the song with the id.
+func (c *mpdConn) playID(args []string) error {
+	if len(args) == 0 {
+		return c.play(nil)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return newMPDError(mpdErrorArg, "Integer expected: %s", args[0])
+	}
+	tracks, _ := c.playlist()
+	for pos, t := range tracks {
+		if t.id == id {
+			return c.play([]string{strconv.Itoa(pos)})
+		}
+	}
+	return newMPDError(mpdErrorNoExist, "No such song")
+}
+
+func (c *mpdConn) pause(args []string) error {
+	_, playing := c.s.bridge.player.Current()
+	pause := playing
+	if len(args) > 0 {
+		pause = args[0] == "1"
+	}
+
+	if err := c.s.bridge.sync(); err != nil {
+		return err
+	}
+	if pause {
+		c.s.bridge.player.Pause("")
+	} else {
+		c.s.bridge.player.Resume("")
+	}
+	c.s.changed("player")
+	return nil
+}
+
+func (c *mpdConn) next(args []string) error {
+	if err := c.s.bridge.sync(); err != nil {
+		return err
+	}
+	c.s.bridge.player.Next("")
+	return nil
+}
+
+func (c *mpdConn) previous(args []string) error {
+	if err := c.s.bridge.sync(); err != nil {
+		return err
+	}
+	c.s.bridge.player.Previous("")
+	return nil
+}
+
+func (c *mpdConn) add(args []string) error {
+	_, err := c.queue(args)
+	return err
+}
+
+func (c *mpdConn) addID(args []string) error {
+	id, err := c.queue(args)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.w, "Id: %d\n", id)
+	return nil
+}
+
+// queue queues the track given as the only argument and returns its id.
+func (c *mpdConn) queue(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, newMPDError(mpdErrorArg, "wrong number of arguments")
+	}
+	if err := c.s.bridge.sync(); err != nil {
+		return 0, err
+	}
+	id, err := c.s.bridge.player.Queue(args[0])
+	if err != nil {
+		return 0, newMPDError(mpdErrorNoExist, "%s", err)
+	}
+	c.s.changed("playlist")
+	return id, nil
+}
+
+// search maps the MPD tags to Spotify search fields.
+func (c *mpdConn) search(args []string) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return newMPDError(mpdErrorArg, "incorrect arguments")
+	}
+	var terms []string
+	for i := 0; i < len(args); i += 2 {
+		value := strings.Replace(args[i+1], `"`, "", -1)
+		switch strings.ToLower(args[i]) {
+		case "any", "file":
+			terms = append(terms, value)
+		case "artist":
+			terms = append(terms, `artist:"`+value+`"`)
+		case "album":
+			terms = append(terms, `album:"`+value+`"`)
+		case "title":
+			terms = append(terms, `track:"`+value+`"`)
+		default:
+			return newMPDError(mpdErrorArg, "unknown tag type: %s", args[i])
+		}
+	}
+
+	if err := c.s.bridge.sync(); err != nil {
+		return err
+	}
+	r, err := c.s.bridge.search(strings.Join(terms, " "), trackSearch(0, mpdSearchLimit))
+	if err != nil {
+		return err
+	}
+	for _, t := range r.Tracks {
+		c.writeSong(t, -1, 0)
+	}
+	return nil
+}
+
+func (c *mpdConn) listPlaylists(args []string) error {
+	if err := c.s.bridge.sync(); err != nil {
+		return err
+	}
+	r, err := c.s.bridge.playlists(0, 1000)
+	if err != nil {
+		return err
+	}
+	for _, p := range r.Playlists {
+		fmt.Fprintf(c.w, "playlist: %s\n", p.Name)
+	}
+	return nil
+}
+
+func (c *mpdConn) setVolume(args []string) error {
+	if len(args) != 1 {
+		return newMPDError(mpdErrorArg, "wrong number of arguments")
+	}
+	volume, err := strconv.Atoi(args[0])
+	if err != nil || volume < 0 || volume > 100 {
+		return newMPDError(mpdErrorArg, "Invalid volume value: %s", args[0])
+	}
+	c.s.audio.SetVolume(volume)
+	c.s.changed("mixer")
+	return nil
+}
+
+// mpdArgs splits the command line into the command and its arguments, which
+// might be quoted.
+func mpdArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+			continue
+		}
+
+		var arg []byte
+		i := 1
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+			}
+			arg = append(arg, line[i])
+		}
+		if i >= len(line) {
+			return nil, errors.New("missing closing '\"'")
+		}
+		args = append(args, string(arg))
+		line = line[i+1:]
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMPDArgs(t *testing.T) {
+	var tests = []struct {
+		line string
+		args []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"   ", nil, false},
+		{"status", []string{"status"}, false},
+		{"  play\t 3 ", []string{"play", "3"}, false},
+		{`add "spotify:track:1"`, []string{"add", "spotify:track:1"}, false},
+		{`search any "daft punk"`, []string{"search", "any", "daft punk"}, false},
+		{`search any ""`, []string{"search", "any", ""}, false},
+		{`search title "say \"hi\" \\ bye"`, []string{"search", "title", `say "hi" \ bye`}, false},
+		{`find "a"b`, []string{"find", "a", "b"}, false},
+		{`search any "daft punk`, nil, true},
+	}
+	for _, test := range tests {
+		args, err := mpdArgs(test.line)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.line, err)
+		} else if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q: %q != %q", test.line, args, test.args)
+		}
+	}
+}
+
+// mpdTestConn is the client side of a connection to the MPD server.
+type mpdTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newMPDTestConn(t *testing.T, tokens ...string) *mpdTestConn {
+	s := &mpdServer{auth: newAuth(tokens), idlers: make(map[chan string]bool)}
+	client, server := net.Pipe()
+	go s.serve(server)
+	t.Cleanup(func() { client.Close() })
+
+	c := &mpdTestConn{t, client, bufio.NewReader(client)}
+	if greeting := c.line(); greeting != "OK MPD "+mpdVersion {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+	return c
+}
+
+func (c *mpdTestConn) line() string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// send sends the lines and returns the response, up to and including the
+// final OK or ACK.
+func (c *mpdTestConn) send(lines ...string) []string {
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(c.conn, line); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	var response []string
+	for {
+		line := c.line()
+		response = append(response, line)
+		if line == "OK" || strings.HasPrefix(line, "ACK ") {
+			return response
+		}
+	}
+}
+
+func TestMPDCommands(t *testing.T) {
+	var tests = []struct {
+		lines    []string
+		response []string
+	}{
+		{[]string{"ping"}, []string{"OK"}},
+		{[]string{"foo"}, []string{`ACK [5@0] {foo} unknown command "foo"`}},
+		{[]string{`ping "`}, []string{`ACK [2@0] {} missing closing '"'`}},
+		{[]string{""}, []string{"ACK [5@0] {} No command given"}},
+		{[]string{"command_list_begin", "ping", "ping", "command_list_end"}, []string{"OK"}},
+		{[]string{"command_list_ok_begin", "ping", "ping", "command_list_end"}, []string{"list_OK", "list_OK", "OK"}},
+		{[]string{"command_list_ok_begin", "ping", "foo", "ping", "command_list_end"}, []string{"list_OK", `ACK [5@1] {foo} unknown command "foo"`}},
+		{[]string{"command_list_begin", "ping", `ping "`, "command_list_end"}, []string{`ACK [2@0] {} missing closing '"'`}},
+		{[]string{"idle", "noidle"}, []string{"OK"}},
+	}
+	c := newMPDTestConn(t)
+	for _, test := range tests {
+		if response := c.send(test.lines...); !reflect.DeepEqual(response, test.response) {
+			t.Errorf("%q: %q != %q", test.lines, response, test.response)
+		}
+	}
+}
+
+func TestMPDPassword(t *testing.T) {
+	var tests = []struct {
+		line     string
+		response string
+	}{
+		{"ping", "OK"},
+		{"status", `ACK [4@0] {status} you don't have permission for "status"`},
+		{"idle", `ACK [4@0] {idle} you don't have permission for "idle"`},
+		{"password wrong", "ACK [3@0] {password} incorrect password"},
+		{"password secret", "OK"},
+		{"setvol 101", "ACK [2@0] {setvol} Invalid volume value: 101"},
+	}
+	c := newMPDTestConn(t, "secret")
+	for _, test := range tests {
+		response := c.send(test.line)
+		if last := response[len(response)-1]; last != test.response {
+			t.Errorf("%q: %q != %q", test.line, last, test.response)
+		}
+	}
+}
+
+// commandNames returns the commands listed in the response.
+func commandNames(response []string) []string {
+	names := []string{}
+	for _, line := range response {
+		if strings.HasPrefix(line, "command: ") {
+			names = append(names, strings.TrimPrefix(line, "command: "))
+		}
+	}
+	return names
+}
+
+func TestMPDCommandLists(t *testing.T) {
+	var all, public, private []string
+	for name := range mpdCommands {
+		all = append(all, name)
+		if mpdPublicCommands[name] {
+			public = append(public, name)
+		} else {
+			private = append(private, name)
+		}
+	}
+	sort.Strings(all)
+	sort.Strings(public)
+	sort.Strings(private)
+
+	var tests = []struct {
+		tokens      []string
+		password    string
+		commands    []string
+		notCommands []string
+	}{
+		{nil, "", all, []string{}},
+		{[]string{"secret"}, "", public, private},
+		{[]string{"secret"}, "secret", all, []string{}},
+	}
+	for i, test := range tests {
+		c := newMPDTestConn(t, test.tokens...)
+		if test.password != "" {
+			c.send("password " + test.password)
+		}
+		if names := commandNames(c.send("commands")); !reflect.DeepEqual(names, test.commands) {
+			t.Errorf("%d: commands: %q != %q", i, names, test.commands)
+		}
+		if names := commandNames(c.send("notcommands")); !reflect.DeepEqual(names, test.notCommands) {
+			t.Errorf("%d: notcommands: %q != %q", i, names, test.notCommands)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package sith
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/op/go-logging"
+)
+
+const (
+	mprisName   = "org.mpris.MediaPlayer2.sith"
+	mprisPath   = "/org/mpris/MediaPlayer2"
+	mprisRoot   = "org.mpris.MediaPlayer2"
+	mprisPlayer = "org.mpris.MediaPlayer2.Player"
+
+	// mprisTrackPath prefixes the track ids, which are object paths.
+	mprisTrackPath = "/org/op/sith/track/"
+)
+
+// mpris exposes the player on the D-Bus session bus using the MPRIS
+// specification, for media keys and desktop media widgets.
+type mpris struct {
+	conn   *dbus.Conn
+	props  *prop.Properties
+	bridge *bridge
+	audio  *audioWriter
+
+	// artURL prefixes album ids to get their image, if set.
+	artURL string
+
+	mu    sync.Mutex
+	track *Track
+}
+
+// newMPRIS connects to the session bus and exports the player. Images are
+// served from baseURL.
+func newMPRIS(bridge *bridge, audio *audioWriter, ew *EventsWriter, baseURL string) (*mpris, error) {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil, errors.New("no session bus")
+	}
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mpris{conn: conn, bridge: bridge, audio: audio}
+	if baseURL != "" {
+		m.artURL = baseURL + strings.TrimPrefix(apiV1, "/") + "/image/album/"
+	}
+	if err := m.export(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := conn.RequestName(mprisName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	} else if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, errors.New(mprisName + " already taken")
+	}
+
+	filter := eventFilter{types: map[string]bool{}, level: logging.CRITICAL}
+	go ew.follow(filter, true, m.event)
+	go m.updatePosition()
+	return m, nil
+}
+
+func (m *mpris) export() error {
+	var err error
+	m.props, err = prop.Export(m.conn, mprisPath, prop.Map{
+		mprisRoot: {
+			"CanQuit":             {Value: false, Emit: prop.EmitConst},
+			"CanRaise":            {Value: false, Emit: prop.EmitConst},
+			"HasTrackList":        {Value: false, Emit: prop.EmitConst},
+			"Identity":            {Value: prog, Emit: prop.EmitConst},
+			"SupportedUriSchemes": {Value: []string{"spotify"}, Emit: prop.EmitConst},
+			"SupportedMimeTypes":  {Value: []string{}, Emit: prop.EmitConst},
+		},
+		mprisPlayer: {
+			"PlaybackStatus": {Value: "Stopped", Emit: prop.EmitTrue},
+			"Rate":           {Value: 1.0, Emit: prop.EmitConst},
+			"MinimumRate":    {Value: 1.0, Emit: prop.EmitConst},
+			"MaximumRate":    {Value: 1.0, Emit: prop.EmitConst},
+			"Metadata":       {Value: map[string]dbus.Variant{}, Emit: prop.EmitTrue},
+			"Volume": {
+				Value:    float64(m.audio.Volume()) / 100,
+				Writable: true,
+				Emit:     prop.EmitTrue,
+				Callback: m.setVolume,
+			},
+			"Position":      {Value: int64(0), Emit: prop.EmitFalse},
+			"CanGoNext":     {Value: true, Emit: prop.EmitConst},
+			"CanGoPrevious": {Value: true, Emit: prop.EmitConst},
+			"CanPlay":       {Value: true, Emit: prop.EmitConst},
+			"CanPause":      {Value: true, Emit: prop.EmitConst},
+			"CanSeek":       {Value: true, Emit: prop.EmitConst},
+			"CanControl":    {Value: true, Emit: prop.EmitConst},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	root := &mprisRootObject{}
+	player := &mprisPlayerObject{m}
+	if err := m.conn.Export(root, mprisPath, mprisRoot); err != nil {
+		return err
+	}
+	if err := m.conn.ExportWithMap(player, mprisPlayerMethods, mprisPath, mprisPlayer); err != nil {
+		return err
+	}
+	playerMethods := introspect.Methods(player)
+	for i, method := range playerMethods {
+		if name, ok := mprisPlayerMethods[method.Name]; ok {
+			playerMethods[i].Name = name
+		}
+	}
+
+	node := &introspect.Node{
+		Name: mprisPath,
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{
+				Name:       mprisRoot,
+				Methods:    introspect.Methods(root),
+				Properties: m.props.Introspection(mprisRoot),
+			},
+			{
+				Name:       mprisPlayer,
+				Methods:    playerMethods,
+				Properties: m.props.Introspection(mprisPlayer),
+				Signals: []introspect.Signal{
+					{Name: "Seeked", Args: []introspect.Arg{{Name: "Position", Type: "x"}}},
+				},
+			},
+		},
+	}
+	return m.conn.Export(introspect.NewIntrospectable(node), mprisPath, "org.freedesktop.DBus.Introspectable")
+}
+
+// Close releases the name and disconnects from the bus.
+func (m *mpris) Close() error {
+	return m.conn.Close()
+}
+
+// event updates the properties on the transitions announced by the events.
+func (m *mpris) event(e Event) {
+	switch e.Type {
+	case "state", "play-track":
+		var data struct {
+			Track *Track `json:"track"`
+		}
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			log.Warning("Failed to decode %s event: %s", e.Type, err)
+			return
+		}
+		m.setTrack(data.Track)
+	case "track-end":
+		m.setTrack(nil)
+	case "play-token-lost", "player-state":
+		m.updateStatus()
+	}
+}
+
+func (m *mpris) setTrack(t *Track) {
+	m.mu.Lock()
+	m.track = t
+	m.mu.Unlock()
+
+	metadata := map[string]dbus.Variant{}
+	if t != nil {
+		metadata["mpris:trackid"] = dbus.MakeVariant(mprisTrackID(t))
+		metadata["mpris:length"] = dbus.MakeVariant(int64(t.Duration * 1e6))
+		metadata["xesam:title"] = dbus.MakeVariant(t.Name)
+		metadata["xesam:url"] = dbus.MakeVariant(t.URI)
+		var artists []string
+		for _, a := range t.Artists {
+			artists = append(artists, a.Name)
+		}
+		metadata["xesam:artist"] = dbus.MakeVariant(artists)
+		if t.Album != nil {
+			metadata["xesam:album"] = dbus.MakeVariant(t.Album.Name)
+			if t.Album.HasImage && m.artURL != "" {
+				metadata["mpris:artUrl"] = dbus.MakeVariant(m.artURL + t.Album.Id)
+			}
+		}
+	}
+	m.props.SetMust(mprisPlayer, "Metadata", metadata)
+	m.updateStatus()
+}
+
+// updateStatus updates the playback status from the player.
+func (m *mpris) updateStatus() {
+	current, playing := m.bridge.player.Current()
+	status := "Stopped"
+	if playing {
+		status = "Playing"
+	} else if current.Track != nil {
+		status = "Paused"
+	}
+	if m.props.GetMust(mprisPlayer, "PlaybackStatus") != status {
+		m.props.SetMust(mprisPlayer, "PlaybackStatus", status)
+	}
+	m.props.SetMust(mprisPlayer, "Position", m.position())
+}
+
+// updatePosition keeps the position property, which is not announced, and the
+// volume, which might be changed elsewhere, up to date.
+func (m *mpris) updatePosition() {
+	for range time.Tick(time.Second) {
+		m.props.SetMust(mprisPlayer, "Position", m.position())
+		volume := float64(m.audio.Volume()) / 100
+		if m.props.GetMust(mprisPlayer, "Volume") != volume {
+			m.props.SetMust(mprisPlayer, "Volume", volume)
+		}
+	}
+}
+
+func (m *mpris) position() int64 {
+	return int64(m.bridge.player.Position() / time.Microsecond)
+}
+
+func (m *mpris) setVolume(c *prop.Change) *dbus.Error {
+	volume, ok := c.Value.(float64)
+	if !ok {
+		return prop.ErrInvalidArg
+	}
+	m.audio.SetVolume(int(volume*100 + 0.5))
+	return nil
+}
+
+// mprisTrackID returns the object path identifying the track.
+func mprisTrackID(t *Track) dbus.ObjectPath {
+	return dbus.ObjectPath(mprisTrackPath + t.URI[strings.LastIndex(t.URI, ":")+1:])
+}
+
+// mprisRootObject implements the org.mpris.MediaPlayer2 methods.
+type mprisRootObject struct{}
+
+func (r *mprisRootObject) Raise() *dbus.Error { return nil }
+func (r *mprisRootObject) Quit() *dbus.Error  { return nil }
+
+// mprisPlayerMethods renames the methods which would otherwise clash with the
+// standard Go method signatures.
+var mprisPlayerMethods = map[string]string{"SeekBy": "Seek"}
+
+// mprisPlayerObject implements the org.mpris.MediaPlayer2.Player methods.
+type mprisPlayerObject struct {
+	m *mpris
+}
+
+func (p *mprisPlayerObject) Next() *dbus.Error {
+	if err := p.m.bridge.sync(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	p.m.bridge.player.Next("")
+	return nil
+}
+
+func (p *mprisPlayerObject) Previous() *dbus.Error {
+	if err := p.m.bridge.sync(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	p.m.bridge.player.Previous("")
+	return nil
+}
+
+func (p *mprisPlayerObject) Pause() *dbus.Error {
+	if err := p.m.bridge.sync(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	p.m.bridge.player.Pause("")
+	p.m.updateStatus()
+	return nil
+}
+
+func (p *mprisPlayerObject) Stop() *dbus.Error {
+	return p.Pause()
+}
+
+func (p *mprisPlayerObject) Play() *dbus.Error {
+	if err := p.m.bridge.sync(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	if current, _ := p.m.bridge.player.Current(); current.Track == nil {
+		p.m.bridge.player.Next("")
+	} else {
+		p.m.bridge.player.Resume("")
+	}
+	p.m.updateStatus()
+	return nil
+}
+
+func (p *mprisPlayerObject) PlayPause() *dbus.Error {
+	if _, playing := p.m.bridge.player.Current(); playing {
+		return p.Pause()
+	}
+	return p.Play()
+}
+
+// SeekBy moves the position by offset microseconds, skipping to the next
+// track when moving past the end. It is exported as Seek.
+func (p *mprisPlayerObject) SeekBy(offset int64) *dbus.Error {
+	p.m.mu.Lock()
+	t := p.m.track
+	p.m.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	position := p.m.position() + offset
+	if position < 0 {
+		position = 0
+	}
+	if float64(position) > t.Duration*1e6 {
+		return p.Next()
+	}
+	return p.SetPosition(mprisTrackID(t), position)
+}
+
+// SetPosition moves the position of the track, in microseconds.
+func (p *mprisPlayerObject) SetPosition(id dbus.ObjectPath, position int64) *dbus.Error {
+	p.m.mu.Lock()
+	t := p.m.track
+	p.m.mu.Unlock()
+	if t == nil || id != mprisTrackID(t) || position < 0 || float64(position) > t.Duration*1e6 {
+		return nil
+	}
+	if err := p.m.bridge.sync(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	p.m.bridge.player.Seek(time.Duration(position) * time.Microsecond)
+	p.m.props.SetMust(mprisPlayer, "Position", position)
+	if err := p.m.conn.Emit(mprisPath, mprisPlayer+".Seeked", position); err != nil {
+		log.Warning("Failed to emit seeked: %s", err)
+	}
+	return nil
+}
+
+// OpenUri plays the track, or the playlist from the start.
+func (p *mprisPlayerObject) OpenUri(uri string) *dbus.Error {
+	if err := p.m.bridge.sync(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	if err := p.m.bridge.load(loadArgs{Context: uri}); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
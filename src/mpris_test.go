@@ -0,0 +1,180 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package sith
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/op/go-libspotify/spotify"
+)
+
+// startSessionBus starts a private session bus and points
+// DBUS_SESSION_BUS_ADDRESS to it for the rest of the test.
+func startSessionBus(t *testing.T) {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--print-address", "--nofork")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", strings.TrimSpace(addr))
+}
+
+// mprisTestClient watches the player from another connection on the bus.
+type mprisTestClient struct {
+	t       *testing.T
+	obj     dbus.BusObject
+	signals chan *dbus.Signal
+}
+
+func newMPRISTestClient(t *testing.T) *mprisTestClient {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.AddMatchSignal(dbus.WithMatchObjectPath(mprisPath)); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 64)
+	conn.Signal(signals)
+	return &mprisTestClient{t, conn.Object(mprisName, mprisPath), signals}
+}
+
+func (c *mprisTestClient) call(method string, args ...interface{}) {
+	if err := c.obj.Call(mprisPlayer+"."+method, 0, args...).Err; err != nil {
+		c.t.Fatalf("%s: %s", method, err)
+	}
+}
+
+// signal waits for the signal, skipping any other.
+func (c *mprisTestClient) signal(name string) *dbus.Signal {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-c.signals:
+			if s.Name == name {
+				return s
+			}
+		case <-timeout:
+			c.t.Fatalf("timeout waiting for %s", name)
+		}
+	}
+}
+
+// changed waits for the player property to change and returns the new value.
+func (c *mprisTestClient) changed(property string) interface{} {
+	for {
+		s := c.signal("org.freedesktop.DBus.Properties.PropertiesChanged")
+		if s.Body[0] != mprisPlayer {
+			continue
+		}
+		if v, ok := s.Body[1].(map[string]dbus.Variant)[property]; ok {
+			return v.Value()
+		}
+	}
+}
+
+func TestMPRIS(t *testing.T) {
+	startSessionBus(t)
+
+	ew := NewEventsWriter()
+	defer ew.Close()
+	p := &player{ew: ew, eot: make(chan string, 1), prev: make(chan string, 1)}
+	p.setCurrent(trackInfo{"uid", new(spotify.Track)}, 0, false)
+	audio := &audioWriter{volume: 100, maxVolume: 100}
+
+	m, err := newMPRIS(&bridge{player: p, running: true}, audio, ew, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c := newMPRISTestClient(t)
+
+	playTrack := func(name string) {
+		ew.SendEvent("play-track", &PlayTrackEvent{
+			UID:   "uid",
+			Track: &Track{URI: "spotify:track:" + name, Name: name, Duration: 180},
+		})
+		metadata := c.changed("Metadata").(map[string]dbus.Variant)
+		if title := metadata["xesam:title"].Value(); title != name {
+			t.Errorf("title: %v != %s", title, name)
+		}
+	}
+	playTrack("first")
+	if status := c.changed("PlaybackStatus"); status != "Paused" {
+		t.Errorf("status after loading: %v", status)
+	}
+
+	c.call("PlayPause")
+	if status := c.changed("PlaybackStatus"); status != "Playing" {
+		t.Errorf("status after play: %v", status)
+	}
+	c.call("PlayPause")
+	if status := c.changed("PlaybackStatus"); status != "Paused" {
+		t.Errorf("status after pause: %v", status)
+	}
+
+	// Playback resumed elsewhere, eg. through the HTTP API.
+	p.Resume("")
+	if status := c.changed("PlaybackStatus"); status != "Playing" {
+		t.Errorf("status after resuming elsewhere: %v", status)
+	}
+
+	c.call("Next")
+	select {
+	case <-p.eot:
+	case <-time.After(5 * time.Second):
+		t.Fatal("next not passed on to the player")
+	}
+	playTrack("second")
+
+	c.call("Seek", int64(10e6))
+	seeked := c.signal(mprisPlayer + ".Seeked")
+	if position := seeked.Body[0].(int64); position < 10e6 || position > 11e6 {
+		t.Errorf("seeked to %d", position)
+	}
+
+	if err := c.obj.SetProperty(mprisPlayer+".Volume", dbus.MakeVariant(0.5)); err != nil {
+		t.Fatal(err)
+	}
+	if volume := c.changed("Volume"); volume != 0.5 {
+		t.Errorf("volume property: %v", volume)
+	}
+	if volume := audio.Volume(); volume != 50 {
+		t.Errorf("volume: %d", volume)
+	}
+}
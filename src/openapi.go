@@ -0,0 +1,154 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/op/sith/api"
+)
+
+// openAPIVersion is the version of the API described.
+const openAPIVersion = "1.0.0"
+
+var pathParamRe = regexp.MustCompile(`:(\w+)`)
+
+// newOpenAPI describes the routes as an OpenAPI 3.1 document.
+func newOpenAPI(routes []*route) schema {
+	b := &schemaBuilder{refs: schema{}, prefix: "#/components/schemas/"}
+	errorResponse := schema{
+		"description": "Error",
+		"content": schema{
+			"application/json": schema{"schema": b.build(reflect.TypeOf(api.ErrorResult{}))},
+		},
+	}
+
+	paths := schema{}
+	for _, r := range routes {
+		path := pathParamRe.ReplaceAllString(r.path, "{$1}")
+		item, ok := paths[path].(schema)
+		if !ok {
+			item = schema{}
+			paths[path] = item
+		}
+
+		params := []schema{}
+		for _, m := range pathParamRe.FindAllStringSubmatch(r.path, -1) {
+			params = append(params, schema{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   schema{"type": "string"},
+			})
+		}
+
+		op := schema{
+			"operationId": r.id,
+			"summary":     r.summary,
+		}
+		if r.deprecated {
+			op["deprecated"] = true
+		}
+		if r.args != nil {
+			if r.method == "GET" {
+				params = append(params, queryParams(reflect.TypeOf(r.args))...)
+			} else {
+				op["requestBody"] = schema{
+					"required": true,
+					"content": schema{
+						"application/json": schema{"schema": b.build(reflect.TypeOf(r.args))},
+					},
+				}
+			}
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		status := r.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := schema{"description": http.StatusText(status)}
+		if r.produces != "" {
+			response["content"] = schema{r.produces: schema{"schema": schema{"type": "string"}}}
+		} else if r.response != nil {
+			response["content"] = schema{
+				"application/json": schema{"schema": b.build(reflect.TypeOf(r.response))},
+			}
+		}
+		op["responses"] = schema{
+			strconv.Itoa(status): response,
+			"default":            errorResponse,
+		}
+
+		item[strings.ToLower(r.method)] = op
+	}
+
+	return schema{
+		"openapi": "3.1.0",
+		"info": schema{
+			"title":   prog,
+			"version": openAPIVersion,
+		},
+		"servers": []schema{{"url": apiV1}},
+		"paths":   paths,
+		"components": schema{
+			"schemas": b.refs,
+			"securitySchemes": schema{
+				"bearer": schema{"type": "http", "scheme": "bearer"},
+				"query":  schema{"type": "apiKey", "in": "query", "name": "oauth_token"},
+				"cookie": schema{"type": "apiKey", "in": "cookie", "name": tokenCookie},
+			},
+		},
+		// Tokens are optional unless configured.
+		"security": []schema{{}, {"bearer": []string{}}, {"query": []string{}}, {"cookie": []string{}}},
+	}
+}
+
+// queryParams describes the query parameters bound to the args struct.
+func queryParams(t reflect.Type) []schema {
+	var params []schema
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("form")
+		if name == "" || f.PkgPath != "" {
+			continue
+		}
+		params = append(params, schema{
+			"name":     name,
+			"in":       "query",
+			"required": f.Tag.Get("binding") == "required",
+			"schema":   jsonSchema(f.Type),
+		})
+	}
+	return params
+}
+
+// openAPIHandler serves the OpenAPI document of the routes.
+func openAPIHandler(routes []*route) func() (int, []byte) {
+	doc, err := json.Marshal(newOpenAPI(routes))
+	if err != nil {
+		panic(err)
+	}
+	return func() (int, []byte) {
+		return http.StatusOK, doc
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// expectedParams lists the path parameters of the route, followed by its query
+// parameters.
+func expectedParams(r *route) []string {
+	var params []string
+	for _, part := range strings.Split(r.path, "/") {
+		if strings.HasPrefix(part, ":") {
+			params = append(params, part[1:])
+		}
+	}
+	if r.args != nil && r.method == "GET" {
+		t := reflect.TypeOf(r.args)
+		for i := 0; i < t.NumField(); i++ {
+			if name := t.Field(i).Tag.Get("form"); name != "" {
+				params = append(params, name)
+			}
+		}
+	}
+	return params
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	routes := newRoutes(&config{LegacyRoutes: true}, &application{}, nil, nil, nil)
+	paths := newOpenAPI(routes)["paths"].(schema)
+
+	ids := make(map[string]bool)
+	operations := 0
+	for _, item := range paths {
+		for _, op := range item.(schema) {
+			ids[op.(schema)["operationId"].(string)] = true
+			operations++
+		}
+	}
+	if operations != len(routes) || len(ids) != len(routes) {
+		t.Errorf("%d operations with %d ids for %d routes", operations, len(ids), len(routes))
+	}
+
+	for _, r := range routes {
+		path := pathParamRe.ReplaceAllString(r.path, "{$1}")
+		item, ok := paths[path].(schema)
+		if !ok {
+			t.Errorf("%s: path %s missing", r.id, path)
+			continue
+		}
+		op, ok := item[strings.ToLower(r.method)].(schema)
+		if !ok {
+			t.Errorf("%s: %s %s missing", r.id, r.method, path)
+			continue
+		}
+		if id := op["operationId"]; id != r.id {
+			t.Errorf("%s: %s %s has id %v", r.id, r.method, path, id)
+		}
+
+		var params []string
+		if ps, ok := op["parameters"].([]schema); ok {
+			for _, p := range ps {
+				params = append(params, p["name"].(string))
+			}
+		}
+		if expected := expectedParams(r); !reflect.DeepEqual(expected, params) {
+			t.Errorf("%s: %v != %v", r.id, expected, params)
+		}
+
+		_, body := op["requestBody"]
+		if expected := r.args != nil && r.method != "GET"; expected != body {
+			t.Errorf("%s: request body %v != %v", r.id, expected, body)
+		}
+	}
+}
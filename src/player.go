@@ -16,6 +16,8 @@ package sith
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/op/go-libspotify/spotify"
 )
@@ -76,14 +78,55 @@ func (st *searchTracks) Get(n int) (trackInfo, error) {
 	return trackInfo{uid, track}, nil
 }
 
+type albumTracks struct {
+	browse *spotify.AlbumBrowse
+}
+
+func (at *albumTracks) URI() string {
+	return at.browse.Album().Link().String()
+}
+
+func (at *albumTracks) Len() int {
+	return at.browse.Tracks()
+}
+
+func (at *albumTracks) Get(n int) (trackInfo, error) {
+	track := at.browse.Track(n)
+	uid := track.Link().String()
+	return trackInfo{uid, track}, nil
+}
+
+type singleTrack struct {
+	track *spotify.Track
+}
+
+func (st *singleTrack) URI() string {
+	return st.track.Link().String()
+}
+
+func (st *singleTrack) Len() int {
+	return 1
+}
+
+func (st *singleTrack) Get(n int) (trackInfo, error) {
+	return trackInfo{st.URI(), st.track}, nil
+}
+
 type playerContext struct {
 	tracks trackList
 
+	// requestID is the request which loaded the context.
+	requestID string
+
 	last  trackInfo
 	index int
 }
 
 func (pc *playerContext) Next() (trackInfo, error) {
+	if pc.tracks.Len() == 0 {
+		pc.last = trackInfo{}
+		return pc.last, nil
+	}
 	i := pc.index
 
 	// Find the current playing track and advance to next. Eg. playlists might
@@ -110,26 +153,61 @@ func (pc *playerContext) Next() (trackInfo, error) {
 	return pc.last, err
 }
 
+// Previous moves back to the track before the last one.
+func (pc *playerContext) Previous() (trackInfo, error) {
+	if pc.tracks.Len() == 0 {
+		pc.last = trackInfo{}
+		return pc.last, nil
+	}
+	var err error
+	pc.index = (pc.index + pc.tracks.Len() - 1) % pc.tracks.Len()
+	pc.last, err = pc.tracks.Get(pc.index)
+	return pc.last, err
+}
+
+// queuedTrack is a queued or the current track, with the id it was given when
+// queued or loaded. Ids are never reused.
+type queuedTrack struct {
+	id    int
+	track *spotify.Track
+}
+
 type player struct {
 	session *spotify.Session
+	ew      *EventsWriter
 
 	// shuffle bool
 	// repeat  bool
 
-	queue chan *spotify.Track
-	play  chan playerContext
-	eot   chan bool
-	quit  chan bool
+	// eot and prev carry the id of the request causing the change, if any.
+	play chan playerContext
+	eot  chan string
+	prev chan string
+	quit chan bool
+
+	mu        sync.Mutex
+	running   bool
+	current   trackInfo
+	currentID int
+	playing   bool
+	queue     []queuedTrack
+	lastID    int
+
+	// The playback position is offset, plus the time since started while
+	// playing.
+	offset  time.Duration
+	started time.Time
 }
 
-func newPlayer(session *spotify.Session, ew EventsWriter) player {
-	p := player{
+func newPlayer(session *spotify.Session, ew *EventsWriter) *player {
+	p := &player{
 		session: session,
+		ew:      ew,
 
-		queue: make(chan *spotify.Track),
-		play:  make(chan playerContext),
-		eot:   make(chan bool),
-		quit:  make(chan bool),
+		play: make(chan playerContext),
+		eot:  make(chan string),
+		prev: make(chan string),
+		quit: make(chan bool),
 	}
 	go p.loadTracks(ew)
 	return p
@@ -140,85 +218,259 @@ func (p *player) Close() error {
 	return nil
 }
 
-func (p *player) Queue(uri string) error {
+// Queue adds the track to the queue and returns the id it was given.
+func (p *player) Queue(uri string) (int, error) {
 	link, err := p.session.ParseLink(uri)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	track, err := link.Track()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	p.queue <- track
-	return nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastID++
+	p.queue = append(p.queue, queuedTrack{p.lastID, track})
+	return p.lastID, nil
+}
+
+// Queued returns the tracks queued to play after the current one.
+func (p *player) Queued() []*spotify.Track {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var tracks []*spotify.Track
+	for _, q := range p.queue {
+		tracks = append(tracks, q.track)
+	}
+	return tracks
+}
+
+// Songs returns the current track, if any, followed by the queued tracks, and
+// if the first track is the current one.
+func (p *player) Songs() ([]queuedTrack, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var songs []queuedTrack
+	if p.current.Track != nil {
+		songs = append(songs, queuedTrack{p.currentID, p.current.Track})
+	}
+	return append(songs, p.queue...), p.current.Track != nil
+}
+
+// dequeue removes and returns the first queued track, if any.
+func (p *player) dequeue() queuedTrack {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return queuedTrack{}
+	}
+	track := p.queue[0]
+	p.queue = p.queue[1:]
+
+	// Release the queue array to make sure we don't grow memory indefinitley
+	if len(p.queue) == 0 {
+		p.queue = nil
+	}
+	return track
 }
 
-func (p *player) Play(tracks trackList, index int) error {
-	p.play <- playerContext{tracks: tracks, index: index}
+// Play starts playing the track at index of tracks. requestID is the request
+// causing it, if any, and is passed on with the resulting events.
+func (p *player) Play(tracks trackList, index int, requestID string) error {
+	p.play <- playerContext{tracks: tracks, index: index, requestID: requestID}
 	return nil
 }
 
 func (p *player) EndOfTrack() {
-	p.eot <- true
+	p.setCurrent(trackInfo{}, 0, false)
+	p.eot <- ""
 }
 
-func (p *player) loadTracks(ew EventsWriter) {
-	var queue []*spotify.Track
+// Next skips to the next queued track or the next track in the context.
+func (p *player) Next(requestID string) {
+	p.eot <- requestID
+}
+
+// Skip drops the first n queued tracks and skips to the next one.
+func (p *player) Skip(n int, requestID string) {
+	p.mu.Lock()
+	if n > len(p.queue) {
+		n = len(p.queue)
+	}
+	p.queue = p.queue[n:]
+	p.mu.Unlock()
+	p.Next(requestID)
+}
+
+// Previous goes back to the previous track in the context.
+func (p *player) Previous(requestID string) {
+	p.prev <- requestID
+}
+
+// Resume continues playing the loaded track.
+func (p *player) Resume(requestID string) {
+	p.session.Player().Play()
+	p.mu.Lock()
+	if !p.playing {
+		p.started = time.Now()
+	}
+	p.playing = p.current.Track != nil
+	p.mu.Unlock()
+	p.sendState(requestID)
+}
+
+// Pause pauses the loaded track.
+func (p *player) Pause(requestID string) {
+	p.session.Player().Pause()
+	p.mu.Lock()
+	p.offset = p.position()
+	p.playing = false
+	p.mu.Unlock()
+	p.sendState(requestID)
+}
+
+// sendState announces that playback was paused or resumed.
+func (p *player) sendState(requestID string) {
+	p.mu.Lock()
+	e := &PlayerStateEvent{
+		eventHeader: eventHeader{RequestID: requestID},
+		Playing:     p.playing,
+		Position:    p.position().Seconds(),
+	}
+	p.mu.Unlock()
+	p.ew.SendEvent("player-state", e)
+}
+
+// Seek moves the playback position of the loaded track.
+func (p *player) Seek(offset time.Duration) {
+	p.session.Player().Seek(offset)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset = offset
+	p.started = time.Now()
+}
+
+// Position returns the playback position of the loaded track.
+func (p *player) Position() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.position()
+}
+
+func (p *player) position() time.Duration {
+	if !p.playing {
+		return p.offset
+	}
+	return p.offset + time.Since(p.started)
+}
+
+// Current returns the currently loaded track and if it is playing.
+func (p *player) Current() (trackInfo, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current, p.playing
+}
+
+// setCurrent sets the loaded track. Tracks not coming from the queue, which
+// have no id, are given a new one.
+func (p *player) setCurrent(current trackInfo, id int, playing bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id == 0 && current.Track != nil {
+		p.lastID++
+		id = p.lastID
+	}
+	p.current = current
+	p.currentID = id
+	p.playing = playing
+	p.offset = 0
+	p.started = time.Now()
+}
+
+// Running reports if the player loop is running.
+func (p *player) Running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+func (p *player) setRunning(running bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running = running
+}
+
+func (p *player) loadTracks(ew *EventsWriter) {
+	p.setRunning(true)
+	defer p.setRunning(false)
+
 	var ctx playerContext
 
 	player := p.session.Player()
 	for {
-		var newCtx bool
+		var newCtx, previous bool
+		var requestID string
 		select {
-		case q := <-p.queue:
-			queue = append(queue, q)
-			continue
 		case ctx = <-p.play:
 			newCtx = true
-		case <-p.eot:
+			requestID = ctx.requestID
+		case requestID = <-p.eot:
 			// do nothing
+		case requestID = <-p.prev:
+			previous = true
 		case <-p.quit:
 			return
 		}
 
 		var next trackInfo
-		if !newCtx && len(queue) > 0 {
-			next = trackInfo{"queue-uid", queue[0]}
-			queue = queue[1:]
+		var queued queuedTrack
+		if !newCtx && !previous {
+			queued = p.dequeue()
+		}
+		if queued.track != nil {
+			next = trackInfo{"queue-uid", queued.track}
+		} else if ctx.tracks == nil {
+			continue
 		} else {
 			var err error
-			println("getting next")
-			next, err = ctx.Next()
+			if previous {
+				next, err = ctx.Previous()
+			} else {
+				next, err = ctx.Next()
+			}
 			if err != nil {
 				log.Error("Failed to fetch next track from context: %s", err.Error())
 				continue
 			}
 			if next.Track == nil {
 				player.Unload()
+				p.setCurrent(trackInfo{}, 0, false)
 			}
 		}
 
-		// Release the queue array to make sure we don't grow memory indefinitley
-		if len(queue) == 0 {
-			queue = nil
-		}
-
 		if next.Track != nil {
 			if err := player.Load(next.Track); err != nil {
 				log.Error("Failed to load track: %s", err.Error())
-				ew.SendEvent("play-track-failed", struct {
-					URI string `json:"uri"`
-				}{next.Track.Link().String()})
+				tracksTotal.WithLabelValues("failed").Inc()
+				ew.SendEvent("play-track-failed", &PlayTrackFailedEvent{
+					eventHeader: eventHeader{RequestID: requestID},
+					URI:         next.Track.Link().String(),
+					Error:       newEventError(err),
+				})
 				continue
 			}
 			player.Play()
-
-			ew.SendEvent("play-track", struct {
-				UID   string `json:"uid"`
-				Track *Track `json:"track"`
-			}{next.UID, newTrack(next.Track)})
+			p.setCurrent(next, queued.id, true)
+
+			tracksTotal.WithLabelValues("played").Inc()
+			ew.SendEvent("play-track", &PlayTrackEvent{
+				eventHeader: eventHeader{RequestID: requestID},
+				UID:         next.UID,
+				Track:       newTrack(next.Track),
+			})
 		}
 	}
 }
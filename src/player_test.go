@@ -0,0 +1,36 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"testing"
+)
+
+// emptyTracks is a context without any tracks, like an empty playlist.
+type emptyTracks struct{}
+
+func (emptyTracks) URI() string                  { return "spotify:user:u:playlist:p" }
+func (emptyTracks) Len() int                     { return 0 }
+func (emptyTracks) Get(n int) (trackInfo, error) { panic("no tracks") }
+
+func TestPlayerContextEmpty(t *testing.T) {
+	pc := &playerContext{tracks: emptyTracks{}}
+	for i, move := range []func() (trackInfo, error){pc.Next, pc.Previous, pc.Next} {
+		track, err := move()
+		if err != nil || track.Track != nil {
+			t.Errorf("%d: expected no track: %v %v", i, track, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/martini-contrib/encoder"
+)
+
+// reloader re-reads the configuration and applies what can be changed while
+// running, without dropping the session or the playback.
+type reloader struct {
+	path  string
+	flags *flag.FlagSet
+
+	bridge   *bridge
+	audio    *audioWriter
+	auth     *auth
+	webhooks *webhooks
+
+	mu  sync.Mutex
+	cfg *config
+}
+
+func newReloader(cfg *config, flags *flag.FlagSet, bridge *bridge, audio *audioWriter, auth *auth, webhooks *webhooks) *reloader {
+	return &reloader{
+		path:     cfg.path,
+		flags:    flags,
+		bridge:   bridge,
+		audio:    audio,
+		auth:     auth,
+		webhooks: webhooks,
+		cfg:      cfg,
+	}
+}
+
+// Reload reads the configuration again and applies the changes.
+func (r *reloader) Reload() (*ReloadResult, error) {
+	cfg, err := loadConfig(r.path, r.flags)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.cfg
+
+	result := &ReloadResult{Applied: []string{}, Restart: []string{}}
+	live := func(name string, changed bool, apply func()) {
+		if changed {
+			apply()
+			result.Applied = append(result.Applied, name)
+		}
+	}
+	restart := func(name string, changed bool) {
+		if changed {
+			result.Restart = append(result.Restart, name)
+		}
+	}
+
+	setupLog := func() {
+		if err := setupLogging(cfg); err != nil {
+			log.Error("Failed to set up logging: %s", err)
+		}
+	}
+	live("color", old.Color != cfg.Color, setupLog)
+	live("log_level", old.LogLevel != cfg.LogLevel, setupLog)
+	live("log_levels", !reflect.DeepEqual(old.LogLevels, cfg.LogLevels), setupLog)
+	live("log_format", old.LogFormat != cfg.LogFormat, setupLog)
+	live("log_file", old.LogFile != cfg.LogFile, setupLog)
+	live("log_max_size", old.LogMaxSize != cfg.LogMaxSize, setupLog)
+	live("log_max_files", old.LogMaxFiles != cfg.LogMaxFiles, setupLog)
+	live("bitrate", old.Bitrate != cfg.Bitrate, func() {
+		if err := r.bridge.sess.PreferredBitrate(bitrates[cfg.Bitrate]); err != nil {
+			log.Error("Failed to change bitrate: %s", err)
+		}
+	})
+	live("audio_device", old.AudioDevice != cfg.AudioDevice, func() {
+		r.audio.SetDevice(cfg.AudioDevice)
+	})
+	live("max_volume", old.MaxVolume != cfg.MaxVolume, func() {
+		r.audio.SetMaxVolume(cfg.MaxVolume)
+	})
+	live("tokens", !reflect.DeepEqual(old.Tokens, cfg.Tokens), func() {
+		r.auth.SetTokens(cfg.Tokens)
+	})
+	live("sync_timeout", old.SyncTimeout != cfg.SyncTimeout, func() {
+		r.bridge.SetSyncTimeout(time.Duration(cfg.SyncTimeout) * time.Second)
+	})
+	live("search_cache_ttl", old.SearchCacheTTL != cfg.SearchCacheTTL, func() {
+		r.bridge.searches.SetTTL(time.Duration(cfg.SearchCacheTTL) * time.Second)
+	})
+	live("webhooks", !reflect.DeepEqual(old.Webhooks, cfg.Webhooks), func() {
+		r.webhooks.SetTargets(cfg.Webhooks)
+	})
+
+	restart("key", old.Key != cfg.Key)
+	restart("username", old.Username != cfg.Username)
+	restart("password", old.Password != cfg.Password)
+	restart("host", old.Host != cfg.Host)
+	restart("port", old.Port != cfg.Port)
+	restart("cache_dir", old.CacheDir != cfg.CacheDir)
+	restart("settings_dir", old.SettingsDir != cfg.SettingsDir)
+	restart("state_dir", old.StateDir != cfg.StateDir)
+	restart("html_dir", old.HTMLDir != cfg.HTMLDir)
+	restart("legacy_routes", old.LegacyRoutes != cfg.LegacyRoutes)
+	restart("unversioned_routes", old.UnversionedRoutes != cfg.UnversionedRoutes)
+	restart("mpd_addr", old.MPDAddr != cfg.MPDAddr)
+	restart("mpris", old.MPRIS != cfg.MPRIS)
+
+	// Keep the settings which require a restart as they currently are in use,
+	// to keep reporting them until the process is restarted.
+	cfg.Key, cfg.Username, cfg.Password = old.Key, old.Username, old.Password
+	cfg.Host, cfg.Port = old.Host, old.Port
+	cfg.CacheDir, cfg.SettingsDir, cfg.StateDir = old.CacheDir, old.SettingsDir, old.StateDir
+	cfg.HTMLDir, cfg.LegacyRoutes, cfg.UnversionedRoutes = old.HTMLDir, old.LegacyRoutes, old.UnversionedRoutes
+	cfg.MPDAddr, cfg.MPRIS = old.MPDAddr, old.MPRIS
+	r.cfg = cfg
+
+	log.Info("Configuration reloaded (applied: %v, requires restart: %v)", result.Applied, result.Restart)
+	return result, nil
+}
+
+// handleSignals reloads the configuration whenever SIGHUP is received.
+func (r *reloader) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if _, err := r.Reload(); err != nil {
+			log.Error("Failed to reload configuration: %s", err)
+		}
+	}
+}
+
+// reload is the HTTP handler for reloading the configuration.
+func (r *reloader) reload(enc encoder.Encoder) (int, []byte) {
+	result, err := r.Reload()
+	if err != nil {
+		e := &apiError{
+			status:      http.StatusBadRequest,
+			Code:        "config_error",
+			Description: err.Error(),
+		}
+		return e.StatusCode(), encoder.Must(enc.Encode(e.Data()))
+	}
+	return http.StatusOK, encoder.Must(enc.Encode(result))
+}
@@ -0,0 +1,226 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/codegangsta/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/encoder"
+)
+
+// apiV1 is the prefix of the current version of the API. Later versions are
+// reserved under /api/v2 and onwards.
+const apiV1 = "/api/v1"
+
+// route is an exposed API method. The same description is used both to
+// register the route and to document it.
+type route struct {
+	method  string
+	path    string
+	id      string
+	summary string
+
+	// args is bound from the query for GET requests, or from the JSON body.
+	args interface{}
+
+	// response is the JSON response, if any. If produces is set, the response
+	// is of that content type instead.
+	response interface{}
+	produces string
+
+	// status is the successful status code, if not 200.
+	status int
+
+	deprecated bool
+	handlers   []martini.Handler
+}
+
+// Handlers returns the handlers to register, including metrics and any
+// argument binding.
+func (r *route) Handlers() []martini.Handler {
+	handlers := []martini.Handler{
+		func(info *requestInfo) { info.route = r.id },
+		routeMetrics(r),
+	}
+	if r.args != nil {
+		handlers = append(handlers, binding.Bind(r.args))
+	}
+	return append(handlers, r.handlers...)
+}
+
+// newRoutes describes the exposed API methods.
+func newRoutes(cfg *config, app *application, ew *EventsWriter, ws *wsHandler, reloader *reloader) []*route {
+	h := func(handlers ...martini.Handler) []martini.Handler { return handlers }
+
+	routes := []*route{
+		{method: "POST", path: "/auth/login", id: "login",
+			summary: "Log in, storing the access token in a cookie.",
+			args:    loginArgs{}, status: 204, handlers: h(app.auth.login)},
+		{method: "POST", path: "/auth/logout", id: "logout",
+			summary: "Log out, removing the access token cookie.",
+			status:  204, handlers: h(app.auth.logout)},
+
+		{method: "GET", path: "/search", id: "search",
+			summary: "Search the Spotify catalogue.",
+			args:    searchArgs{}, response: SearchResult{}, handlers: h(app.search)},
+		{method: "GET", path: "/search/suggest", id: "suggest",
+			summary: "Suggest the top matches while typing a search.",
+			args:    suggestArgs{}, response: SuggestResult{}, handlers: h(app.suggestions.suggest)},
+		{method: "GET", path: "/search/history", id: "searchHistory",
+			summary:  "List the latest searches of the user.",
+			response: HistoryResult{}, handlers: h(app.history.list)},
+		{method: "DELETE", path: "/search/history", id: "clearSearchHistory",
+			summary: "Clear the search history of the user.",
+			status:  204, handlers: h(app.history.clear)},
+		{method: "GET", path: "/search/saved", id: "savedSearches",
+			summary:  "List the saved searches of the user.",
+			response: SavedSearchesResult{}, handlers: h(app.history.saved)},
+		{method: "POST", path: "/search/saved", id: "saveSearch",
+			summary: "Save a search under a name.",
+			args:    saveSearchArgs{}, response: SavedSearch{}, status: 201, handlers: h(app.history.save)},
+		{method: "DELETE", path: "/search/saved/:id", id: "deleteSavedSearch",
+			summary: "Delete a saved search.",
+			status:  204, handlers: h(app.history.remove)},
+		{method: "GET", path: "/playlists", id: "playlists",
+			summary: "List the playlists of the user.",
+			args:    playlistsArgs{}, response: PlaylistsResult{}, handlers: h(app.playlists)},
+		{method: "GET", path: "/user/:username/playlist/:id", id: "playlist",
+			summary: "Get a playlist and its tracks.",
+			args:    playlistArgs{}, response: PlaylistResult{}, handlers: h(app.playlist)},
+		{method: "GET", path: "/album/:id", id: "album",
+			summary:  "Get an album and its tracks.",
+			response: AlbumResult{}, handlers: h(app.album)},
+		{method: "GET", path: "/image/user/:username/:entity/:id", id: "userImage",
+			summary: "Get the image of a playlist.",
+			args:    imageArgs{}, produces: "image/jpeg", handlers: h(app.image)},
+		{method: "GET", path: "/image/:entity/:id", id: "image",
+			summary: "Get the image of an album or artist.",
+			args:    imageArgs{}, produces: "image/jpeg", handlers: h(app.image)},
+
+		{method: "GET", path: "/player/status", id: "status",
+			summary:  "Get the state of the player.",
+			response: StatusResult{}, handlers: h(app.status)},
+		{method: "POST", path: "/player/play", id: "play",
+			summary: "Resume playback.", handlers: h(app.play)},
+		{method: "POST", path: "/player/pause", id: "pause",
+			summary: "Pause playback.", handlers: h(app.pause)},
+		{method: "POST", path: "/player/next", id: "next",
+			summary: "Skip to the next track.", handlers: h(app.next)},
+		{method: "POST", path: "/player/load", id: "load",
+			summary: "Play the track at the index of a playlist, search, album or track context.",
+			args:    loadArgs{}, handlers: h(app.load)},
+		{method: "POST", path: "/player/queue", id: "queue",
+			summary: "Queue a track to play after the current one.",
+			args:    queueArgs{}, handlers: h(app.queue)},
+		{method: "GET", path: "/player/queue", id: "getQueue",
+			summary:  "List the queued tracks.",
+			response: QueueResult{}, handlers: h(app.queued)},
+		{method: "POST", path: "/player/seek", id: "seek",
+			summary: "Move the playback position.",
+			args:    seekArgs{}, handlers: h(app.seek)},
+		{method: "GET", path: "/player/volume", id: "getVolume",
+			summary:  "Get the volume.",
+			response: VolumeResult{}, handlers: h(app.volume)},
+		{method: "PUT", path: "/player/volume", id: "setVolume",
+			summary: "Set the volume.",
+			args:    volumeArgs{}, response: VolumeResult{}, handlers: h(app.setVolume)},
+
+		{method: "GET", path: "/events", id: "events",
+			summary:  "Stream events as server sent events.",
+			produces: "text/event-stream", handlers: h(ew.ServeHTTP)},
+		{method: "GET", path: "/events/schema", id: "eventSchema",
+			summary:  "Get the event catalogue.",
+			response: EventCatalogue{}, handlers: h(ew.schema)},
+		{method: "GET", path: "/ws", id: "websocket",
+			summary: "Upgrade to the WebSocket event and control channel.",
+			status:  101, handlers: h(ws.ServeHTTP)},
+
+		{method: "GET", path: "/log", id: "log",
+			summary: "Get the latest log entries.",
+			args:    logArgs{}, response: LogResult{}, handlers: h(recentLogs.serve)},
+		{method: "POST", path: "/admin/reload", id: "reload",
+			summary:  "Reload the configuration.",
+			response: ReloadResult{}, handlers: h(reloader.reload)},
+	}
+
+	if cfg.LegacyRoutes {
+		// State changing GET routes, kept for old clients.
+		routes = append(routes,
+			&route{method: "GET", path: "/player/play", id: "legacyPlay",
+				summary: "Resume playback.", deprecated: true, handlers: h(app.play)},
+			&route{method: "GET", path: "/player/pause", id: "legacyPause",
+				summary: "Pause playback.", deprecated: true, handlers: h(app.pause)},
+			&route{method: "GET", path: "/player/load", id: "legacyLoad",
+				summary: "Play the track at the index of a playlist or search context.",
+				args:    loadArgs{}, deprecated: true, handlers: h(app.load)},
+		)
+	}
+	return routes
+}
+
+// newAPIRouter registers the routes under the versioned prefix, and at the
+// root as well if unversioned is set, together with the OpenAPI document. Any
+// other request under /api fails.
+func newAPIRouter(routes []*route, unversioned bool) martini.Router {
+	router := martini.NewRouter()
+	for _, r := range routes {
+		router.AddRoute(r.method, apiV1+r.path, r.Handlers()...)
+		if unversioned {
+			handlers := append([]martini.Handler{deprecatedRoute(r)}, r.Handlers()...)
+			router.AddRoute(r.method, r.path, handlers...)
+		}
+	}
+	openAPI := openAPIHandler(routes)
+	router.Get("/api/openapi.json", openAPI)
+	router.Get(apiV1+"/openapi.json", openAPI)
+	router.Any("/api/**", unknownAPIVersion)
+	return router
+}
+
+// deprecatedRoute marks responses from the route registered outside of the
+// versioned prefix as deprecated, pointing to its successor.
+func deprecatedRoute(r *route) martini.Handler {
+	var once sync.Once
+	return func(w http.ResponseWriter, req *http.Request) {
+		once.Do(func() {
+			log.Warning("Deprecated route %s %s used, use %s%s instead", r.method, r.path, apiV1, r.path)
+		})
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiV1+req.URL.Path+`>; rel="successor-version"`)
+	}
+}
+
+// unknownAPIVersion handles requests to API versions not (yet) available.
+func unknownAPIVersion(req *http.Request, enc encoder.Encoder) (int, []byte) {
+	var err *apiError
+	if strings.HasPrefix(req.URL.Path, apiV1+"/") {
+		err = &apiError{
+			status:      http.StatusNotFound,
+			Code:        "not_found",
+			Description: "no such method: " + req.URL.Path,
+		}
+	} else {
+		err = &apiError{
+			status:      http.StatusNotImplemented,
+			Code:        "unsupported_version",
+			Description: "unsupported API version, use " + apiV1,
+		}
+	}
+	return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+}
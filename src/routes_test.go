@@ -0,0 +1,163 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/codegangsta/martini"
+	"github.com/martini-contrib/encoder"
+	"github.com/op/sith/api"
+	"github.com/op/sith/client"
+)
+
+// jsonTestEncoder encodes responses as JSON.
+type jsonTestEncoder struct{}
+
+func (jsonTestEncoder) Encode(v ...interface{}) ([]byte, error) {
+	return json.Marshal(v[0])
+}
+
+// newTestAPI serves the routes like the instance does.
+func newTestAPI(routes []*route, unversioned bool) http.Handler {
+	m := martini.New()
+	m.Use(accessHandler)
+	m.Use(func(c martini.Context) {
+		c.MapTo(jsonTestEncoder{}, (*encoder.Encoder)(nil))
+	})
+	m.Action(newAPIRouter(routes, unversioned).Handle)
+	return m
+}
+
+func TestAPIRouter(t *testing.T) {
+	routes := []*route{
+		{method: "GET", path: "/x", id: "x",
+			handlers: []martini.Handler{func() (int, []byte) { return http.StatusOK, []byte(`"x"`) }}},
+	}
+	var tests = []struct {
+		unversioned bool
+		method      string
+		path        string
+		status      int
+		code        string
+		deprecated  bool
+	}{
+		{true, "GET", "/api/v1/x", http.StatusOK, "", false},
+		{true, "GET", "/x", http.StatusOK, "", true},
+		{false, "GET", "/x", http.StatusNotFound, "", false},
+		{true, "POST", "/api/v1/x", http.StatusNotFound, "not_found", false},
+		{true, "GET", "/api/v1/y", http.StatusNotFound, "not_found", false},
+		{true, "GET", "/api/v2/x", http.StatusNotImplemented, "unsupported_version", false},
+		{false, "POST", "/api/v2/player/play", http.StatusNotImplemented, "unsupported_version", false},
+		{true, "GET", "/api/openapi.json", http.StatusOK, "", false},
+		{true, "GET", "/api/v1/openapi.json", http.StatusOK, "", false},
+	}
+	for _, test := range tests {
+		api := newTestAPI(routes, test.unversioned)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s %s: status %d != %d", test.method, test.path, w.Code, test.status)
+		}
+		if test.code != "" {
+			var data struct {
+				Error struct{ Code string } `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil || data.Error.Code != test.code {
+				t.Errorf("%s %s: expected %s: %s", test.method, test.path, test.code, w.Body)
+			}
+		}
+
+		deprecated := w.Header().Get("Deprecation") == "true"
+		if deprecated != test.deprecated {
+			t.Errorf("%s %s: deprecated %v != %v", test.method, test.path, deprecated, test.deprecated)
+		}
+		if link := w.Header().Get("Link"); test.deprecated && link != `</api/v1/x>; rel="successor-version"` {
+			t.Errorf("%s %s: link: %s", test.method, test.path, link)
+		}
+	}
+}
+
+func TestClientRoutes(t *testing.T) {
+	// Replace the handlers to record which route each call ends up at.
+	var hit string
+	var routes []*route
+	for _, r := range newRoutes(&config{}, &application{}, nil, nil, nil) {
+		r := *r
+		r.args = nil
+		r.handlers = []martini.Handler{func(info *requestInfo) (int, []byte) {
+			hit = info.route
+			return http.StatusOK, []byte("{}")
+		}}
+		routes = append(routes, &r)
+	}
+	server := httptest.NewServer(newTestAPI(routes, false))
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		id   string
+		call func() error
+	}{
+		{"search", func() error { _, err := c.Search("q", &client.Page{Page: 2}); return err }},
+		{"search", func() error {
+			_, err := c.SearchWith("q", &client.SearchOptions{Types: []string{"track"}})
+			return err
+		}},
+		{"searchHistory", func() error { _, err := c.SearchHistory(); return err }},
+		{"clearSearchHistory", func() error { return c.ClearSearchHistory() }},
+		{"savedSearches", func() error { _, err := c.SavedSearches(); return err }},
+		{"saveSearch", func() error { _, err := c.SaveSearch("n", "q"); return err }},
+		{"deleteSavedSearch", func() error { return c.DeleteSavedSearch("1") }},
+		{"playlists", func() error { _, err := c.Playlists(nil); return err }},
+		{"playlist", func() error { _, err := c.Playlist("u", "p", nil); return err }},
+		{"album", func() error { _, err := c.Album("a"); return err }},
+		{"image", func() error { _, err := c.Image("artist", "a"); return err }},
+		{"userImage", func() error { _, err := c.PlaylistImage("u", "p"); return err }},
+		{"status", func() error { _, err := c.Status(); return err }},
+		{"play", func() error { return c.Play() }},
+		{"pause", func() error { return c.Pause() }},
+		{"next", func() error { return c.Next() }},
+		{"load", func() error { return c.Load(&api.LoadRequest{Context: "c"}) }},
+		{"queue", func() error { return c.Queue("spotify:track:x") }},
+		{"getQueue", func() error { _, err := c.Queued(); return err }},
+		{"seek", func() error { return c.Seek(1) }},
+		{"getVolume", func() error { _, err := c.Volume(); return err }},
+		{"setVolume", func() error { _, err := c.SetVolume(10); return err }},
+		{"reload", func() error { _, err := c.Reload(); return err }},
+		{"events", func() error {
+			s, err := c.Events(url.Values{})
+			if err == nil {
+				s.Close()
+			}
+			return err
+		}},
+	}
+	for _, test := range tests {
+		hit = ""
+		if err := test.call(); err != nil {
+			t.Errorf("%s: %v", test.id, err)
+		} else if hit != test.id {
+			t.Errorf("%s: route %q called", test.id, hit)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// schema is a JSON schema document.
+type schema map[string]interface{}
+
+// jsonSchema describes how values of the given type are serialized by
+// encoding/json, as a JSON schema.
+func jsonSchema(t reflect.Type) schema {
+	return (&schemaBuilder{}).build(t)
+}
+
+// schemaBuilder builds JSON schemas. When refs is set, named struct types are
+// added to it and referenced by prefix and name instead of being inlined.
+type schemaBuilder struct {
+	refs   schema
+	prefix string
+}
+
+func (b *schemaBuilder) build(t reflect.Type) schema {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+
+	var s schema
+	switch {
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return schema{}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return schema{"type": "string", "contentEncoding": "base64"}
+	case b.refs != nil && t.Kind() == reflect.Struct && t.Name() != "" && t.PkgPath() != "":
+		if _, ok := b.refs[t.Name()]; !ok {
+			// Reserve the name first to handle recursive types.
+			b.refs[t.Name()] = schema{}
+			b.refs[t.Name()] = b.object(t)
+		}
+		s = schema{"$ref": b.prefix + t.Name()}
+		if nullable {
+			return schema{"anyOf": []schema{s, {"type": "null"}}}
+		}
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		s = schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s = schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		s = schema{"type": "number"}
+	case reflect.String:
+		s = schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		s = schema{"type": "array", "items": b.build(t.Elem())}
+		nullable = nullable || t.Kind() == reflect.Slice
+	case reflect.Map:
+		s = schema{"type": "object", "additionalProperties": b.build(t.Elem())}
+		nullable = true
+	case reflect.Struct:
+		s = b.object(t)
+	default:
+		s = schema{}
+	}
+
+	if nullable {
+		if typ, ok := s["type"].(string); ok {
+			s["type"] = []string{typ, "null"}
+		}
+	}
+	return s
+}
+
+// object describes a struct as a JSON object.
+func (b *schemaBuilder) object(t reflect.Type) schema {
+	properties := schema{}
+	required := []string{}
+	b.addFields(t, properties, &required)
+	s := schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// addFields adds the serialized fields of the struct, including any from
+// embedded structs, to properties.
+func (b *schemaBuilder) addFields(t reflect.Type, properties schema, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.addFields(f.Type, properties, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = b.build(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type schemaTest struct {
+	eventHeader
+	Name     string            `json:"name"`
+	Count    int               `json:"count,omitempty"`
+	Ratio    float64           `json:"ratio"`
+	Data     []byte            `json:"data"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels"`
+	Track    *SimpleArtist     `json:"track"`
+	Ignored  string            `json:"-"`
+	Untagged bool
+	hidden   string
+}
+
+type schemaNode struct {
+	Children []*schemaNode `json:"children"`
+}
+
+func TestJSONSchema(t *testing.T) {
+	var tests = []struct {
+		value interface{}
+		want  string
+	}{
+		{true, `{"type":"boolean"}`},
+		{uint8(1), `{"type":"integer"}`},
+		{1.5, `{"type":"number"}`},
+		{"", `{"type":"string"}`},
+		{[]int{}, `{"items":{"type":"integer"},"type":["array","null"]}`},
+		{[2]int{}, `{"items":{"type":"integer"},"type":"array"}`},
+		{[]byte{}, `{"contentEncoding":"base64","type":"string"}`},
+		{json.RawMessage{}, `{}`},
+		{map[string]bool{}, `{"additionalProperties":{"type":"boolean"},"type":["object","null"]}`},
+		{new(string), `{"type":["string","null"]}`},
+		{schemaTest{}, `{"properties":{` +
+			`"Untagged":{"type":"boolean"},` +
+			`"count":{"type":"integer"},` +
+			`"data":{"contentEncoding":"base64","type":"string"},` +
+			`"labels":{"additionalProperties":{"type":"string"},"type":["object","null"]},` +
+			`"name":{"type":"string"},` +
+			`"ratio":{"type":"number"},` +
+			`"request_id":{"type":"string"},` +
+			`"tags":{"items":{"type":"string"},"type":["array","null"]},` +
+			`"track":{"properties":{"name":{"type":"string"},"uri":{"type":"string"}},"required":["uri","name"],"type":["object","null"]},` +
+			`"version":{"type":"integer"}},` +
+			`"required":["version","name","ratio","data","tags","labels","track","Untagged"],` +
+			`"type":"object"}`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(jsonSchema(reflect.TypeOf(test.value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.want {
+			t.Errorf("%T:\n%s !=\n%s", test.value, data, test.want)
+		}
+	}
+}
+
+func TestJSONSchemaRefs(t *testing.T) {
+	b := &schemaBuilder{refs: schema{}, prefix: "#/defs/"}
+	data, err := json.Marshal(b.build(reflect.TypeOf(&schemaNode{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"anyOf":[{"$ref":"#/defs/schemaNode"},{"type":"null"}]}`; string(data) != want {
+		t.Errorf("%s != %s", data, want)
+	}
+
+	data, err = json.Marshal(b.refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"schemaNode":{"properties":{"children":{"items":{"anyOf":[{"$ref":"#/defs/schemaNode"},{"type":"null"}]},"type":["array","null"]}},"required":["children"],"type":"object"}}`
+	if string(data) != want {
+		t.Errorf("%s != %s", data, want)
+	}
+}
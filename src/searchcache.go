@@ -0,0 +1,178 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/op/go-libspotify/spotify"
+)
+
+const (
+	// searchCacheSize is the number of searches kept in the cache.
+	searchCacheSize = 100
+
+	// searchContextSize is the number of tracks searched for when playing a
+	// search context.
+	searchContextSize = 50
+)
+
+// searchCache keeps the latest loaded searches, keyed by query and options,
+// for a limited time. It is shared between searching and playing searches.
+type searchCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+type searchCacheEntry struct {
+	key     string
+	query   string
+	opts    spotify.SearchOptions
+	search  *spotify.Search
+	expires time.Time
+}
+
+// newSearchCache creates a cache keeping searches for ttl. A ttl of zero
+// disables the cache.
+func newSearchCache(ttl time.Duration) *searchCache {
+	return &searchCache{
+		ttl:     ttl,
+		entries: list.New(),
+		index:   make(map[string]*list.Element),
+	}
+}
+
+func searchCacheKey(query string, opts *spotify.SearchOptions) string {
+	return fmt.Sprintf("%q %v", query, *opts)
+}
+
+// SetTTL changes how long searches are kept, dropping all cached ones.
+func (c *searchCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	c.entries.Init()
+	c.index = make(map[string]*list.Element)
+}
+
+// Get returns the cached search for the query and options, if any.
+func (c *searchCache) Get(query string, opts *spotify.SearchOptions) *spotify.Search {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.index[searchCacheKey(query, opts)]
+	return c.hit(e, ok)
+}
+
+// Find returns the latest cached search for the query with options matching
+// match, if any.
+func (c *searchCache) Find(query string, match func(opts *spotify.SearchOptions) bool) *spotify.Search {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.entries.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*searchCacheEntry)
+		if entry.query == query && match(&entry.opts) && time.Now().Before(entry.expires) {
+			return c.hit(e, true)
+		}
+	}
+	return c.hit(nil, false)
+}
+
+// hit records the result of a lookup, refreshing the entry if found.
+func (c *searchCache) hit(e *list.Element, ok bool) *spotify.Search {
+	if ok {
+		entry := e.Value.(*searchCacheEntry)
+		if time.Now().Before(entry.expires) {
+			searchCacheLookups.WithLabelValues("hit").Inc()
+			c.entries.MoveToFront(e)
+			return entry.search
+		}
+		c.remove(e)
+	}
+	searchCacheLookups.WithLabelValues("miss").Inc()
+	return nil
+}
+
+// Add caches the loaded search, dropping the least recently used search if
+// the cache is full.
+func (c *searchCache) Add(query string, opts *spotify.SearchOptions, search *spotify.Search) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	key := searchCacheKey(query, opts)
+	if e, ok := c.index[key]; ok {
+		c.remove(e)
+	}
+	c.index[key] = c.entries.PushFront(&searchCacheEntry{
+		key:     key,
+		query:   query,
+		opts:    *opts,
+		search:  search,
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.entries.Len() > searchCacheSize {
+		c.remove(c.entries.Back())
+	}
+}
+
+func (c *searchCache) remove(e *list.Element) {
+	c.entries.Remove(e)
+	delete(c.index, e.Value.(*searchCacheEntry).key)
+}
+
+// cachedSearch returns the loaded search for the query and options, from the
+// cache when possible.
+func (b *bridge) cachedSearch(query string, opts *spotify.SearchOptions) (*spotify.Search, *apiError) {
+	if search := b.searches.Get(query, opts); search != nil {
+		return search, nil
+	}
+	search, err := b.sess.Search(query, opts)
+	if err != nil {
+		log.Info(err.Error())
+		return nil, newInternalServerError(err.Error())
+	}
+	if err := waitLoaded("search "+query, search.Wait); err != nil {
+		return nil, err
+	}
+	if err := search.Error(); err != nil {
+		log.Info(err.Error())
+		return nil, newInternalServerError(err.Error())
+	}
+	b.searches.Add(query, opts, search)
+	return search, nil
+}
+
+// contextSearch returns the search to play the track at index of, reusing
+// any cached search which starts from the first track and includes it, eg.
+// the page of results the track was picked from.
+func (b *bridge) contextSearch(query string, index int) (*spotify.Search, *apiError) {
+	search := b.searches.Find(query, func(opts *spotify.SearchOptions) bool {
+		return opts.Tracks.Offset == 0 && opts.Tracks.Count > index
+	})
+	if search != nil {
+		return search, nil
+	}
+	size := searchContextSize
+	if index >= size {
+		size = index + 1
+	}
+	return b.cachedSearch(query, trackSearch(0, size))
+}
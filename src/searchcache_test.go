@@ -0,0 +1,126 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/op/go-libspotify/spotify"
+)
+
+// expire makes the cached search for the query and options expired.
+func expire(c *searchCache, query string, opts *spotify.SearchOptions) {
+	c.index[searchCacheKey(query, opts)].Value.(*searchCacheEntry).expires = time.Now().Add(-time.Second)
+}
+
+func TestSearchCacheLRU(t *testing.T) {
+	c := newSearchCache(time.Minute)
+	opts := trackSearch(0, 10)
+	for i := 0; i < searchCacheSize; i++ {
+		c.Add(fmt.Sprint(i), opts, &spotify.Search{})
+	}
+
+	// Using the oldest search keeps it when the cache overflows.
+	if c.Get("0", opts) == nil {
+		t.Fatal("expected 0 to be cached")
+	}
+	c.Add("new", opts, &spotify.Search{})
+	c.Add("0", opts, &spotify.Search{})
+
+	if c.entries.Len() != searchCacheSize || len(c.index) != searchCacheSize {
+		t.Errorf("size: %d %d", c.entries.Len(), len(c.index))
+	}
+	var tests = []struct {
+		query  string
+		cached bool
+	}{
+		{"0", true},
+		{"1", false},
+		{"2", true},
+		{"new", true},
+		{fmt.Sprint(searchCacheSize - 1), true},
+	}
+	for _, test := range tests {
+		if cached := c.Get(test.query, opts) != nil; cached != test.cached {
+			t.Errorf("%s: %v != %v", test.query, cached, test.cached)
+		}
+	}
+	if c.Get("new", trackSearch(10, 10)) != nil {
+		t.Error("expected options to be part of the key")
+	}
+}
+
+func TestSearchCacheTTL(t *testing.T) {
+	c := newSearchCache(time.Minute)
+	c.Add("a", trackSearch(0, 10), &spotify.Search{})
+	c.Add("b", trackSearch(0, 10), &spotify.Search{})
+	expire(c, "a", trackSearch(0, 10))
+
+	if c.Get("a", trackSearch(0, 10)) != nil {
+		t.Error("expected a to have expired")
+	}
+	if _, ok := c.index[searchCacheKey("a", trackSearch(0, 10))]; ok {
+		t.Error("expected expired search to be removed")
+	}
+	if c.Get("b", trackSearch(0, 10)) == nil {
+		t.Error("expected b to be cached")
+	}
+
+	// Changing the TTL drops all searches, and zero disables the cache.
+	c.SetTTL(0)
+	if c.Get("b", trackSearch(0, 10)) != nil {
+		t.Error("expected b to be dropped")
+	}
+	c.Add("c", trackSearch(0, 10), &spotify.Search{})
+	if c.entries.Len() != 0 {
+		t.Error("expected nothing to be cached")
+	}
+}
+
+func TestSearchCacheFind(t *testing.T) {
+	c := newSearchCache(time.Minute)
+	c.Add("q", trackSearch(10, 10), &spotify.Search{})
+	c.Add("q", &spotify.SearchOptions{Artists: spotify.SearchSpec{Count: 10}}, &spotify.Search{})
+	c.Add("q", trackSearch(0, 10), &spotify.Search{})
+	c.Add("other", trackSearch(0, 50), &spotify.Search{})
+
+	// The context reuses a search from the first track including the index.
+	var tests = []struct {
+		query string
+		index int
+		found bool
+	}{
+		{"q", 0, true},
+		{"q", 9, true},
+		{"q", 10, false},
+		{"other", 49, true},
+		{"missing", 0, false},
+	}
+	for _, test := range tests {
+		search := c.Find(test.query, func(opts *spotify.SearchOptions) bool {
+			return opts.Tracks.Offset == 0 && opts.Tracks.Count > test.index
+		})
+		if found := search != nil; found != test.found {
+			t.Errorf("%s/%d: %v != %v", test.query, test.index, found, test.found)
+		}
+	}
+
+	expire(c, "q", trackSearch(0, 10))
+	if c.Find("q", func(opts *spotify.SearchOptions) bool { return opts.Tracks.Offset == 0 && opts.Tracks.Count > 0 }) != nil {
+		t.Error("expected expired searches to be skipped")
+	}
+}
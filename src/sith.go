@@ -23,13 +23,12 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
 
 	"github.com/codegangsta/martini"
-	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/encoder"
 	"github.com/op/go-libspotify/spotify"
 	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -38,87 +37,173 @@ var (
 )
 
 var (
-	appKeyPath = flag.String("key", "spotify_appkey.key", "path to app.key")
-	username   = flag.String("username", "o.p", "spotify username")
-	password   = flag.String("password", "", "spotify password")
-	port       = flag.Int("port", 8107, "HTTP port interface")
-	color      = flag.Bool("color", true, "output log in colors")
+	defaults = defaultConfig()
+
+	configPath = flag.String("config", "", "path to configuration file (default "+defaultConfigPath()+")")
+	_          = flag.String("key", defaults.Key, "path to app.key")
+	_          = flag.String("username", defaults.Username, "spotify username")
+	_          = flag.String("password", "", "spotify password")
+	_          = flag.String("host", defaults.Host, "HTTP interface address")
+	_          = flag.Int("port", defaults.Port, "HTTP port interface")
+	_          = flag.Bool("color", defaults.Color, "output log in colors")
+	_          = flag.String("log-level", defaults.LogLevel, "log level")
+	_          = flag.String("log-levels", "", "log level per module, eg. libspotify=warning,libspotify.ap=debug")
+	_          = flag.String("log-format", defaults.LogFormat, "log format (text or json)")
+	_          = flag.String("log-file", "", "write the log to this file instead of stderr")
+	_          = flag.Int("log-max-size", defaults.LogMaxSize, "rotate the log file at this size in MB (0 never rotates)")
+	_          = flag.Int("log-max-files", defaults.LogMaxFiles, "number of rotated log files to keep")
+	_          = flag.Int("bitrate", defaults.Bitrate, "preferred bitrate in kbit/s (96, 160 or 320)")
+	_          = flag.String("audio-device", "", "audio output device (default system default)")
+	_          = flag.Int("max-volume", defaults.MaxVolume, "maximum volume in percent")
+	_          = flag.String("cache-dir", defaults.CacheDir, "libspotify cache directory")
+	_          = flag.String("settings-dir", defaults.SettingsDir, "libspotify settings directory")
+	_          = flag.String("state-dir", defaults.StateDir, "application state directory")
+	_          = flag.String("html-dir", "", "serve the web interface from this directory (default embedded)")
+	_          = flag.Bool("legacy-routes", false, "keep the deprecated GET routes changing the player state")
+	_          = flag.Bool("unversioned-routes", defaults.UnversionedRoutes, "keep the deprecated API routes outside of "+apiV1)
+	_          = flag.Int("search-cache-ttl", defaults.SearchCacheTTL, "seconds to cache searches (0 disables the cache)")
+	_          = flag.Int("sync-timeout", defaults.SyncTimeout, "seconds to wait for the session before failing requests (0 waits forever)")
+	_          = flag.Bool("mpris", defaults.MPRIS, "expose the player on the D-Bus session bus")
+	_          = flag.String("mpd-addr", "", "serve the MPD protocol at this address, eg. 127.0.0.1:6600 (default disabled)")
 )
 
 // Run is the main entry point for this program.
 func Run() {
 	flag.Parse()
-	setupLogging()
+
+	cfg, err := loadConfig(*configPath, flag.CommandLine)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", prog, err)
+		os.Exit(1)
+	}
+
+	mode := flag.Arg(0)
+	switch mode {
+	case "":
+	case "tui":
+		defaultLogFile = cfg.LogPath()
+	case "config":
+		os.Exit(configCommand(cfg, flag.Args()[1:]))
+	case "ctl":
+		os.Exit(ctlCommand(cfg, flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n", prog, flag.Arg(0))
+		os.Exit(2)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid configuration: %s\n", prog, err)
+		os.Exit(1)
+	}
+	if err := setupLogging(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: log: %s\n", prog, err)
+		os.Exit(1)
+	}
 
 	eventsWriter := NewEventsWriter()
 	defer eventsWriter.Close()
 
-	audio, err := newAudioWriter()
+	audio, err := newAudioWriter(cfg)
 	if err != nil {
 		panic(err)
 	}
 	defer audio.Close()
+	registerAudioMetrics(audio)
+
+	auth := newAuth(cfg.Tokens)
 
 	// TODO there's a limitation with libspotify, we can only have one logged in
 	//      user per process. maybe we should create a layer that spawns a new
 	//      process for each session required and have a small layer between?
 	//      that's why this is currently called a bridge. it doesn't do much
 	//      right now.
-	bridge := newBridge(newSession(&audio), eventsWriter)
-	app := &application{}
+	bridge := newBridge(cfg, newSession(cfg, audio), eventsWriter)
+	app := &application{
+		auth:        auth,
+		suggestions: newSuggester(),
+		history:     newSearchHistory(cfg.SearchHistoryPath()),
+	}
+
+	webhooks := newWebhooks(cfg, eventsWriter)
+
+	if cfg.MPDAddr != "" {
+		mpd := newMPDServer(bridge, audio, auth, eventsWriter)
+		go func() {
+			if err := mpd.ListenAndServe(cfg.MPDAddr); err != nil {
+				log.Error("Failed to start MPD interface: %s", err)
+			}
+		}()
+	}
+
+	if cfg.MPRIS {
+		// Album art is only available to others when not requiring a token.
+		var baseURL string
+		if len(cfg.Tokens) == 0 {
+			baseURL = cfg.URL()
+		}
+		if mpris, err := newMPRIS(bridge, audio, eventsWriter, baseURL); err != nil {
+			log.Info("MPRIS interface not available: %s", err)
+		} else {
+			defer mpris.Close()
+		}
+	}
 
-	root := resourcePath()
+	reloader := newReloader(cfg, flag.CommandLine, bridge, audio, auth, webhooks)
+	go reloader.handleSignals()
 
 	m := martini.New()
-	m.Use(martini.Static(
-		filepath.Join(root, "html"),
-	))
+	m.Use(accessHandler)
+	m.Use(staticHandler(resourceFS(cfg)))
 	m.Use(func(c martini.Context, w http.ResponseWriter) {
 		c.MapTo(encoder.JsonEncoder{}, (*encoder.Encoder)(nil))
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	})
+	m.Use(auth.Handler)
+	m.Use(csrfHandler)
 	m.Map(bridge)
+	m.Map(audio)
 
 	// Exposed API methods
-	router := martini.NewRouter()
-	router.Get("/search", binding.Bind(searchArgs{}), app.search)
-	router.Get("/playlists", binding.Bind(playlistsArgs{}), app.playlists)
-	router.Get("/user/:username/playlist/:id", binding.Bind(playlistArgs{}), app.playlist)
-	router.Get("/image/user/:username/:entity/:id", app.image)
-	router.Get("/image/:entity/:id", app.image)
-	router.Get("/player/play", app.play)
-	router.Get("/player/pause", app.pause)
-	router.Get("/player/load", binding.Bind(loadArgs{}), app.load)
-
-	router.Get("/events", eventsWriter.ServeHTTP)
+	routes := newRoutes(cfg, app, eventsWriter, newWSHandler(bridge, audio, eventsWriter), reloader)
+	router := newAPIRouter(routes, cfg.UnversionedRoutes)
+	router.Get("/metrics", promhttp.Handler().ServeHTTP)
+
+	health := &health{bridge, audio}
+	router.Get("/healthz", health.healthz)
+	router.Get("/readyz", health.readyz)
+	go sdWatchdog(health)
 
 	m.Action(router.Handle)
 
-	addr := fmt.Sprintf("127.0.0.1:%d", *port)
+	addr := cfg.Addr()
 	log.Info("Starting up HTTP interface at %s", addr)
 	server := http.Server{
 		Addr:    addr,
 		Handler: m,
 	}
+	if mode == "tui" {
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				log.Error("Failed to start HTTP interface: %s", err)
+			}
+		}()
+		if err := runTUI(bridge, audio, eventsWriter); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", prog, err)
+		}
+		bridge.Stop()
+		return
+	}
 	server.ListenAndServe()
 
 	// go signalHandler(api, server)
 
 	// TODO add and try to enforce use of TLS
-	log.Debug("Starting up HTTP interface on %d", *port)
+	log.Debug("Starting up HTTP interface on %s", addr)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start HTTP interface: %s", err)
 	}
 }
 
-func setupLogging() {
-	logBackend := logging.NewLogBackend(os.Stderr, "", 0)
-	logBackend.Color = *color
-
-	logging.SetFormatter(logging.MustStringFormatter("%{time:2006-01-02T15:04:05.000} %{module} %{message}"))
-	logging.SetBackend(logBackend)
-}
-
 func signalHandler(bridge *bridge, server *http.Server) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, os.Kill)
@@ -132,46 +217,37 @@ func signalHandler(bridge *bridge, server *http.Server) {
 	}
 }
 
-// resourcePath returns the path to the directory which contains the
-// application resources.
-func resourcePath() string {
-	_, file, _, ok := runtime.Caller(1)
-	if !ok {
-		panic("failed to find package folder")
-	}
-	dir := filepath.Join(filepath.Dir(file), "..")
-
-	// Verify that the path actually is what we believe it is.
-	if _, err := os.Stat(filepath.Join(dir, "html")); err != nil {
-		if os.IsNotExist(err) {
-			// TODO add support for keeping resources in eg /usr/share
-			panic("package installed in the file system not implemented")
-		}
-		panic(err)
-	}
-	return dir
-}
-
 // newSession creates a new libspotify session.
-func newSession(audio spotify.AudioConsumer) *spotify.Session {
-	appKey, err := ioutil.ReadFile(*appKeyPath)
+func newSession(cfg *config, audio spotify.AudioConsumer) *spotify.Session {
+	appKey, err := ioutil.ReadFile(cfg.Key)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// TODO select better cache locations
+	for _, dir := range []string{cfg.CacheDir, cfg.SettingsDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	session, err := spotify.NewSession(&spotify.Config{
 		ApplicationKey:   appKey,
 		ApplicationName:  prog,
-		CacheLocation:    "tmp",
-		SettingsLocation: "tmp",
+		CacheLocation:    cfg.CacheDir,
+		SettingsLocation: cfg.SettingsDir,
 		AudioConsumer:    audio,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := session.PreferredBitrate(bitrates[cfg.Bitrate]); err != nil {
+		log.Fatal(err)
+	}
 
 	// TODO move control of the session into the API
 	credentials := spotify.Credentials{
-		Username: *username,
-		Password: *password,
+		Username: cfg.Username,
+		Password: cfg.Password,
 	}
 	remember := false
 	if err = session.Login(credentials, remember); err != nil {
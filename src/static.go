@@ -0,0 +1,146 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/codegangsta/martini"
+	"github.com/op/sith/html"
+)
+
+const (
+	// staticMaxAge is how long browsers may cache the vendored assets.
+	staticMaxAge = "public, max-age=86400"
+
+	// staticRevalidate makes browsers check the page and templates on every
+	// use since they change together with the application.
+	staticRevalidate = "no-cache"
+)
+
+// resourceFS returns the file system to serve the web interface from. An
+// explicitly configured directory is used first, then any installed in one of
+// the XDG data directories, eg. /usr/share/sith/html, and finally the assets
+// embedded in the binary.
+func resourceFS(cfg *config) http.FileSystem {
+	if cfg.HTMLDir != "" {
+		log.Info("Serving web interface from %s", cfg.HTMLDir)
+		return http.Dir(cfg.HTMLDir)
+	}
+	if dir := installedResourceDir(); dir != "" {
+		log.Info("Serving web interface from %s", dir)
+		return http.Dir(dir)
+	}
+	return http.FS(html.Files)
+}
+
+// installedResourceDir returns the web interface directory installed in the
+// file system, or an empty string if there is none.
+func installedResourceDir() string {
+	dirs := []string{os.Getenv("XDG_DATA_HOME")}
+	if dirs[0] == "" {
+		dirs[0] = filepath.Join(os.Getenv("HOME"), ".local", "share")
+	}
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+	dirs = append(dirs, filepath.SplitList(dataDirs)...)
+
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		dir = filepath.Join(dir, prog, "html")
+		if _, err := os.Stat(filepath.Join(dir, "index.html")); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// staticHandler serves the files found in fs, leaving any other request to the
+// next handler.
+func staticHandler(fs http.FileSystem) martini.Handler {
+	var (
+		mu    sync.Mutex
+		etags = make(map[string]string)
+	)
+
+	// The tag is computed once for each version of a file, keyed by its
+	// modification time and size to pick up changes in the file system.
+	etag := func(name string, fi os.FileInfo, f http.File) (string, error) {
+		key := fmt.Sprintf("%s %d %d", name, fi.ModTime().UnixNano(), fi.Size())
+
+		mu.Lock()
+		defer mu.Unlock()
+		if tag, ok := etags[key]; ok {
+			return tag, nil
+		}
+		h := sha1.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		tag := `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+		etags[key] = tag
+		return tag, nil
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+
+		f, err := fs.Open(name)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			return
+		}
+
+		tag, err := etag(name, fi, f)
+		if err != nil {
+			log.Error("Failed to read %s: %s", name, err)
+			return
+		}
+
+		cacheControl := staticMaxAge
+		if name == "/index.html" || strings.HasPrefix(name, "/tmpl/") || strings.HasPrefix(name, "/js/") {
+			cacheControl = staticRevalidate
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", tag)
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+	}
+}
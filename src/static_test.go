@@ -0,0 +1,142 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestFiles creates the files under dir.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"index.html":       "index",
+		"tmpl/search.html": "search",
+		"js/sith.js":       "sith",
+		"lib/vendor.js":    "vendor",
+	})
+	handler := staticHandler(http.Dir(dir)).(func(http.ResponseWriter, *http.Request))
+	serve := func(method, path, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	var tests = []struct {
+		path         string
+		body         string
+		cacheControl string
+	}{
+		{"/", "index", staticRevalidate},
+		{"/index.html", "index", staticRevalidate},
+		{"/tmpl/search.html", "search", staticRevalidate},
+		{"/js/sith.js", "sith", staticRevalidate},
+		{"/lib/vendor.js", "vendor", staticMaxAge},
+		{"/lib/../lib/vendor.js", "vendor", staticMaxAge},
+	}
+	for _, test := range tests {
+		w := serve("GET", test.path, "")
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("%s: %d %q", test.path, w.Code, w.Body)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != test.cacheControl {
+			t.Errorf("%s: cache control %q != %q", test.path, cc, test.cacheControl)
+		}
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Errorf("%s: no etag", test.path)
+		}
+
+		w = serve("GET", test.path, etag)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: %d %q with matching etag", test.path, w.Code, w.Body)
+		}
+		if w = serve("GET", test.path, `"other"`); w.Code != http.StatusOK {
+			t.Errorf("%s: %d with other etag", test.path, w.Code)
+		}
+	}
+
+	// A changed file gets a new tag.
+	etag := serve("GET", "/lib/vendor.js", "").Header().Get("ETag")
+	writeTestFiles(t, dir, map[string]string{"lib/vendor.js": "vendor 2"})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, "lib/vendor.js"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve("GET", "/lib/vendor.js", etag); w.Code != http.StatusOK || w.Body.String() != "vendor 2" {
+		t.Errorf("changed file: %d %q", w.Code, w.Body)
+	}
+
+	// Anything else is left to the next handler.
+	for _, r := range []struct{ method, path string }{
+		{"POST", "/index.html"},
+		{"GET", "/missing.js"},
+		{"GET", "/lib"},
+		{"GET", "/api/v1/player/status"},
+	} {
+		if w := serve(r.method, r.path, ""); w.Body.Len() != 0 || len(w.Header()) != 0 {
+			t.Errorf("%s %s: served", r.method, r.path)
+		}
+	}
+}
+
+func TestResourceFS(t *testing.T) {
+	home := t.TempDir()
+	data := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("XDG_DATA_DIRS", "relative:"+data)
+
+	// The embedded assets are used if none are installed.
+	if _, ok := resourceFS(&config{}).(http.Dir); ok {
+		t.Error("expected embedded assets")
+	}
+
+	writeTestFiles(t, data, map[string]string{filepath.Join(prog, "html", "index.html"): "data"})
+	if fs := resourceFS(&config{}); fs != http.Dir(filepath.Join(data, prog, "html")) {
+		t.Errorf("data dir: %v", fs)
+	}
+	writeTestFiles(t, home, map[string]string{filepath.Join(".local", "share", prog, "html", "index.html"): "home"})
+	if fs := resourceFS(&config{}); fs != http.Dir(filepath.Join(home, ".local", "share", prog, "html")) {
+		t.Errorf("data home: %v", fs)
+	}
+
+	// The configured directory comes first.
+	if fs := resourceFS(&config{HTMLDir: "/srv/html"}); fs != http.Dir("/srv/html") {
+		t.Errorf("html dir: %v", fs)
+	}
+}
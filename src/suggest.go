@@ -0,0 +1,188 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/martini-contrib/encoder"
+	"github.com/op/go-libspotify/spotify"
+)
+
+const (
+	// suggestDelay is how long to wait for the next keystroke before
+	// searching.
+	suggestDelay = 150 * time.Millisecond
+
+	// suggestTimeout is how long to wait for the search to load.
+	suggestTimeout = 2 * time.Second
+
+	// suggestPollInterval is how often to check if the search has loaded.
+	suggestPollInterval = 20 * time.Millisecond
+
+	suggestLimit    = 3
+	suggestMaxLimit = 10
+)
+
+// suggester answers searches made while typing. Each client only has one
+// suggestion in flight; a newer query supersedes the previous one, which
+// then returns without waiting for its search.
+type suggester struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+func newSuggester() *suggester {
+	return &suggester{pending: make(map[string]chan struct{})}
+}
+
+// begin supersedes any previous query from the client. The returned channel
+// is closed if this query is superseded in turn, and end must be called once
+// done.
+func (s *suggester) begin(client string) (superseded chan struct{}, end func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous, ok := s.pending[client]; ok {
+		close(previous)
+	}
+	superseded = make(chan struct{})
+	s.pending[client] = superseded
+	return superseded, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pending[client] == superseded {
+			delete(s.pending, client)
+		}
+	}
+}
+
+type suggestArgs struct {
+	Query string `form:"query" json:"query" binding:"required"`
+	Limit int    `form:"limit" json:"limit"`
+
+	// Client identifies the client, eg. a browser tab, whose previous query
+	// is superseded. Queries without one are never superseded.
+	Client string `form:"client" json:"client"`
+}
+
+// suggest returns the top matches for the query. Superseded queries fail
+// with the code superseded, which clients can ignore.
+func (s *suggester) suggest(bridge *bridge, enc encoder.Encoder, args suggestArgs, info *requestInfo) (int, []byte) {
+	if err := bridge.sync(); err != nil {
+		return err.StatusCode(), encoder.Must(enc.Encode(err.Data()))
+	}
+
+	limit := args.Limit
+	if limit <= 0 {
+		limit = suggestLimit
+	} else if limit > suggestMaxLimit {
+		limit = suggestMaxLimit
+	}
+
+	// The client id is scoped to who the client authenticated as, so that
+	// it can't be used to supersede the queries of others.
+	client := info.ID
+	if validRequestID(args.Client) {
+		client = args.Client
+	}
+	superseded, end := s.begin(info.identity + " " + client)
+	defer end()
+
+	result, e := bridge.suggest(args.Query, limit, superseded)
+	if e != nil {
+		return e.StatusCode(), encoder.Must(enc.Encode(e.Data()))
+	}
+	return http.StatusOK, encoder.Must(enc.Encode(result))
+}
+
+// suggest searches for suggestions, unless superseded is closed first. Only
+// items which have already been loaded are included.
+func (b *bridge) suggest(query string, limit int, superseded chan struct{}) (*SuggestResult, *apiError) {
+	errSuperseded := newConflictError("superseded", "superseded by a later query")
+
+	select {
+	case <-time.After(suggestDelay):
+	case <-superseded:
+		return nil, errSuperseded
+	}
+
+	defer observeLoad("suggest", time.Now())
+	spec := spotify.SearchSpec{Offset: 0, Count: limit}
+	search, err := b.sess.Search(query, &spotify.SearchOptions{
+		Artists:   spec,
+		Albums:    spec,
+		Tracks:    spec,
+		Playlists: spec,
+		Type:      spotify.SearchSuggest,
+	})
+	if err != nil {
+		return nil, newInternalServerError(err.Error())
+	}
+
+	// Poll rather than wait, since a wait can't be cancelled when the query
+	// is superseded.
+	poll := time.NewTicker(suggestPollInterval)
+	defer poll.Stop()
+	timeout := time.NewTimer(suggestTimeout)
+	defer timeout.Stop()
+	for !search.IsLoaded() {
+		select {
+		case <-poll.C:
+		case <-superseded:
+			return nil, errSuperseded
+		case <-timeout.C:
+			return nil, newUnavailableError("search timed out")
+		}
+	}
+
+	result := &SuggestResult{
+		Query:     query,
+		Artists:   []*Suggestion{},
+		Albums:    []*Suggestion{},
+		Tracks:    []*Suggestion{},
+		Playlists: []*Suggestion{},
+	}
+	for i := 0; i < search.Artists(); i++ {
+		if a := search.Artist(i); a.IsLoaded() {
+			result.Artists = append(result.Artists, &Suggestion{URI: a.Link().String(), Name: a.Name()})
+		}
+	}
+	for i := 0; i < search.Albums(); i++ {
+		if a := search.Album(i); a.IsLoaded() {
+			result.Albums = append(result.Albums, &Suggestion{
+				URI:    a.Link().String(),
+				Name:   a.Name(),
+				Artist: a.Artist().Name(),
+			})
+		}
+	}
+	for i := 0; i < search.Tracks(); i++ {
+		if t := search.Track(i); t.IsLoaded() {
+			s := &Suggestion{URI: t.Link().String(), Name: t.Name()}
+			if t.Artists() > 0 {
+				s.Artist = t.Artist(0).Name()
+			}
+			result.Tracks = append(result.Tracks, s)
+		}
+	}
+	for i := 0; i < search.Playlists(); i++ {
+		if p := search.Playlist(i); p.IsLoaded() {
+			result.Playlists = append(result.Playlists, &Suggestion{URI: p.Link().String(), Name: p.Name()})
+		}
+	}
+	return result, nil
+}
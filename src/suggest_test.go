@@ -0,0 +1,62 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import "testing"
+
+func closed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSuggesterBegin(t *testing.T) {
+	s := newSuggester()
+
+	a1, endA1 := s.begin("a")
+	b1, endB1 := s.begin("b")
+	if closed(a1) || closed(b1) {
+		t.Fatal("expected queries from different clients to be independent")
+	}
+
+	// A newer query supersedes the previous one from the same client.
+	a2, endA2 := s.begin("a")
+	if !closed(a1) || closed(a2) || closed(b1) {
+		t.Error("expected only the previous query of a to be superseded")
+	}
+
+	// Ending a superseded query keeps the newer one pending.
+	endA1()
+	a3, endA3 := s.begin("a")
+	if !closed(a2) || closed(a3) {
+		t.Error("expected the pending query to be superseded")
+	}
+
+	// Ending the latest query forgets the client.
+	endA2()
+	endA3()
+	endB1()
+	if len(s.pending) != 0 {
+		t.Errorf("pending: %v", s.pending)
+	}
+	a4, endA4 := s.begin("a")
+	defer endA4()
+	if closed(a4) {
+		t.Error("expected a new query to start out pending")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to the service manager, as described by sd_notify(3).
+// Nothing is sent unless started with NOTIFY_SOCKET set.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog tells the service manager when the instance first becomes
+// ready. If a watchdog is configured, it is then kept alive for as long as the
+// session events keep being processed within the watchdog interval and the
+// player loop is running. A stuck session makes the watchdog expire.
+func sdWatchdog(h *health) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	var interval time.Duration
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		interval = time.Duration(usec) * time.Microsecond / 2
+	}
+	tick := interval
+	if tick == 0 || tick > time.Second {
+		tick = time.Second
+	}
+
+	ready, stalled := false, false
+	var last time.Time
+	for range time.Tick(tick) {
+		if !ready && h.Ready() {
+			ready = true
+			if err := sdNotify("READY=1"); err != nil {
+				log.Warning("Failed to notify service manager: %s", err)
+			}
+		}
+		if interval == 0 {
+			if ready {
+				return
+			}
+			continue
+		}
+		if time.Since(last) < interval {
+			continue
+		}
+		if !h.Alive(interval) {
+			if !stalled {
+				log.Error("Session stalled, not keeping the watchdog alive")
+			}
+			stalled = true
+			continue
+		}
+		stalled = false
+		last = time.Now()
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Warning("Failed to notify watchdog: %s", err)
+		}
+	}
+}
@@ -0,0 +1,558 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+	"github.com/op/go-logging"
+)
+
+const (
+	tuiSeekStep   = 10 * time.Second
+	tuiVolumeStep = 5
+
+	// tuiLimit is the number of search results and playlist items loaded. It
+	// matches the tracks available when playing a search context.
+	tuiLimit = 50
+)
+
+// The panes of the terminal interface, in the order of their tabs.
+const (
+	paneSearch = iota
+	panePlaylists
+	panePlaylist
+	paneQueue
+)
+
+const tuiHelp = "space play/pause  n next  ←/→ seek  +/- volume  enter play  a queue  / search  q quit"
+
+// tuiItem is a row in a list. uri is the track or playlist it refers to.
+type tuiItem struct {
+	columns []string
+	uri     string
+}
+
+// tuiList is the content of a pane.
+type tuiList struct {
+	name     string
+	columns  []string
+	items    []tuiItem
+	selected int
+	top      int
+
+	// ctx and query describes the context items are played in, if any.
+	ctx   string
+	query string
+}
+
+func (l *tuiList) move(n int) {
+	l.selected += n
+	if l.selected >= len(l.items) {
+		l.selected = len(l.items) - 1
+	}
+	if l.selected < 0 {
+		l.selected = 0
+	}
+}
+
+func (l *tuiList) current() *tuiItem {
+	if l.selected < len(l.items) {
+		return &l.items[l.selected]
+	}
+	return nil
+}
+
+func (l *tuiList) setTracks(tracks []*Track) {
+	l.columns = []string{"TRACK", "ARTIST", "ALBUM", "LENGTH"}
+	l.items = nil
+	for _, t := range tracks {
+		var album string
+		if t.Album != nil {
+			album = t.Album.Name
+		}
+		l.items = append(l.items, tuiItem{
+			columns: []string{t.Name, trackArtists(t), album, trackDuration(t)},
+			uri:     t.URI,
+		})
+	}
+	l.selected, l.top = 0, 0
+}
+
+// tui is an interactive terminal interface, controlling the player directly.
+type tui struct {
+	bridge *bridge
+	audio  *audioWriter
+	ew     *EventsWriter
+
+	lists   []*tuiList
+	pane    int
+	editing bool
+	query   []rune
+	message string
+
+	// track is the playing track, as last announced by the events.
+	track *Track
+
+	updates chan func()
+}
+
+// runTUI runs the terminal interface until the user quits.
+func runTUI(bridge *bridge, audio *audioWriter, ew *EventsWriter) error {
+	if err := termbox.Init(); err != nil {
+		return err
+	}
+	defer termbox.Close()
+
+	t := &tui{
+		bridge: bridge,
+		audio:  audio,
+		ew:     ew,
+		lists: []*tuiList{
+			paneSearch:    {name: "Search"},
+			panePlaylists: {name: "Playlists"},
+			panePlaylist:  {name: "Playlist"},
+			paneQueue:     {name: "Queue"},
+		},
+		updates: make(chan func()),
+	}
+	t.loadPlaylists()
+	return t.run()
+}
+
+func (t *tui) run() error {
+	keys := make(chan termbox.Event)
+	go func() {
+		for {
+			keys <- termbox.PollEvent()
+		}
+	}()
+	events := make(chan Event)
+	filter := eventFilter{types: map[string]bool{}, level: logging.WARNING}
+	go t.ew.follow(filter, true, func(e Event) { events <- e })
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		t.draw()
+		select {
+		case e := <-keys:
+			switch e.Type {
+			case termbox.EventError:
+				return e.Err
+			case termbox.EventKey:
+				if !t.key(e) {
+					return nil
+				}
+			}
+		case e := <-events:
+			t.event(e)
+		case update := <-t.updates:
+			update()
+		case <-ticker.C:
+		}
+	}
+}
+
+// event updates the interface from an event.
+func (t *tui) event(e Event) {
+	var data struct {
+		Track   *Track      `json:"track"`
+		Message string      `json:"message"`
+		Error   *EventError `json:"error"`
+	}
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		log.Warning("Failed to decode %s event: %s", e.Type, err)
+		return
+	}
+
+	switch e.Type {
+	case "state", "play-track":
+		t.track = data.Track
+		t.loadQueue()
+	case "play-token-lost":
+		t.message = "Playback paused, the account is used elsewhere"
+	case "logged-out":
+		t.message = "Logged out"
+	case "log", "user-message":
+		t.message = data.Message
+	default:
+		if data.Error != nil {
+			t.message = e.Type + ": " + data.Error.Message
+		}
+	}
+}
+
+// do runs f in the background, since it might block waiting for the session
+// or metadata, and applies the returned update in the interface loop.
+func (t *tui) do(f func() (func(), error)) {
+	go func() {
+		var update func()
+		var err error
+		if syncErr := t.bridge.sync(); syncErr != nil {
+			err = syncErr
+		} else {
+			update, err = f()
+		}
+		t.updates <- func() {
+			if err != nil {
+				t.message = err.Error()
+			} else if update != nil {
+				update()
+			}
+		}
+	}()
+}
+
+func (t *tui) search(query string) {
+	t.message = "Searching..."
+	t.do(func() (func(), error) {
+		r, err := t.bridge.search(query, trackSearch(0, tuiLimit))
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			l := t.lists[paneSearch]
+			l.setTracks(r.Tracks)
+			l.ctx, l.query = r.URI, query
+			t.message = fmt.Sprintf("%d of %d tracks found", len(r.Tracks), r.Totals.Tracks)
+			if r.DidYouMean != "" {
+				t.message += fmt.Sprintf(", did you mean %q?", r.DidYouMean)
+			}
+		}, nil
+	})
+}
+
+func (t *tui) loadPlaylists() {
+	t.do(func() (func(), error) {
+		r, err := t.bridge.playlists(0, tuiLimit)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			l := t.lists[panePlaylists]
+			l.columns = []string{"PLAYLIST", "OWNER", "SUBSCRIBERS"}
+			l.items = nil
+			for _, p := range r.Playlists {
+				l.items = append(l.items, tuiItem{
+					columns: []string{p.Name, p.Owner, strconv.Itoa(p.Subscribers)},
+					uri:     p.URI,
+				})
+			}
+		}, nil
+	})
+}
+
+func (t *tui) loadPlaylist(uri string) {
+	t.do(func() (func(), error) {
+		r, err := t.bridge.playlist(uri, 0, tuiLimit)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			var tracks []*Track
+			for _, item := range r.Playlist.Items {
+				tracks = append(tracks, item.Track)
+			}
+			l := t.lists[panePlaylist]
+			l.name = r.Playlist.Name
+			l.setTracks(tracks)
+			l.ctx = uri
+			t.pane = panePlaylist
+		}, nil
+	})
+}
+
+func (t *tui) loadQueue() {
+	t.do(func() (func(), error) {
+		var tracks []*Track
+		for _, track := range t.bridge.player.Queued() {
+			track.Wait()
+			tracks = append(tracks, newTrack(track))
+		}
+		return func() { t.lists[paneQueue].setTracks(tracks) }, nil
+	})
+}
+
+// key handles a key press and returns false when the user quits.
+func (t *tui) key(e termbox.Event) bool {
+	if t.editing {
+		switch e.Key {
+		case termbox.KeyEnter:
+			t.editing = false
+			if len(t.query) > 0 {
+				t.search(string(t.query))
+			}
+		case termbox.KeyEsc:
+			t.editing = false
+		case termbox.KeyBackspace, termbox.KeyBackspace2:
+			if len(t.query) > 0 {
+				t.query = t.query[:len(t.query)-1]
+			}
+		case termbox.KeySpace:
+			t.query = append(t.query, ' ')
+		default:
+			if e.Ch != 0 {
+				t.query = append(t.query, e.Ch)
+			}
+		}
+		return true
+	}
+
+	l := t.lists[t.pane]
+	_, height := termbox.Size()
+	page := height - 5
+
+	switch e.Key {
+	case termbox.KeyCtrlC:
+		return false
+	case termbox.KeyTab:
+		t.pane = (t.pane + 1) % len(t.lists)
+	case termbox.KeyArrowUp:
+		l.move(-1)
+	case termbox.KeyArrowDown:
+		l.move(1)
+	case termbox.KeyPgup:
+		l.move(-page)
+	case termbox.KeyPgdn:
+		l.move(page)
+	case termbox.KeyHome:
+		l.move(-len(l.items))
+	case termbox.KeyEnd:
+		l.move(len(l.items))
+	case termbox.KeyArrowLeft:
+		t.seek(-tuiSeekStep)
+	case termbox.KeyArrowRight:
+		t.seek(tuiSeekStep)
+	case termbox.KeySpace:
+		t.toggle()
+	case termbox.KeyEnter:
+		t.enter()
+	}
+
+	switch e.Ch {
+	case 'q':
+		return false
+	case '1', '2', '3', '4':
+		t.pane = int(e.Ch - '1')
+		if t.pane == paneQueue {
+			t.loadQueue()
+		}
+	case 'k':
+		l.move(-1)
+	case 'j':
+		l.move(1)
+	case 'g':
+		l.move(-len(l.items))
+	case 'G':
+		l.move(len(l.items))
+	case '/':
+		t.pane = paneSearch
+		t.editing = true
+		t.query = nil
+	case 'n':
+		t.do(func() (func(), error) {
+			t.bridge.player.Next("")
+			return nil, nil
+		})
+	case '+', '=':
+		t.audio.SetVolume(t.audio.Volume() + tuiVolumeStep)
+	case '-':
+		t.audio.SetVolume(t.audio.Volume() - tuiVolumeStep)
+	case 'a':
+		if item := l.current(); item != nil && t.pane != panePlaylists {
+			uri := item.uri
+			t.do(func() (func(), error) {
+				if _, err := t.bridge.player.Queue(uri); err != nil {
+					return nil, err
+				}
+				return func() { t.message = "Queued " + item.columns[0] }, nil
+			})
+			t.loadQueue()
+		}
+	case 'r':
+		t.loadPlaylists()
+	}
+	return true
+}
+
+// enter opens the selected playlist or plays the selected track.
+func (t *tui) enter() {
+	l := t.lists[t.pane]
+	item := l.current()
+	if item == nil {
+		return
+	}
+	if t.pane == panePlaylists {
+		t.loadPlaylist(item.uri)
+		return
+	}
+
+	args := loadArgs{Context: l.ctx, Index: l.selected, URI: item.uri, Query: l.query}
+	if l.ctx == "" {
+		args = loadArgs{Context: item.uri}
+	}
+	t.do(func() (func(), error) {
+		if err := t.bridge.load(args); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+}
+
+func (t *tui) toggle() {
+	t.do(func() (func(), error) {
+		if _, playing := t.bridge.player.Current(); playing {
+			t.bridge.player.Pause("")
+		} else {
+			t.bridge.player.Resume("")
+		}
+		return nil, nil
+	})
+}
+
+func (t *tui) seek(d time.Duration) {
+	t.do(func() (func(), error) {
+		position := t.bridge.player.Position() + d
+		if position < 0 {
+			position = 0
+		}
+		t.bridge.player.Seek(position)
+		return nil, nil
+	})
+}
+
+func (t *tui) draw() {
+	const (
+		fg = termbox.ColorDefault
+		bg = termbox.ColorDefault
+	)
+	termbox.Clear(fg, bg)
+	width, height := termbox.Size()
+
+	// Tabs
+	x := 0
+	for i, l := range t.lists {
+		attr := fg
+		if i == t.pane {
+			attr |= termbox.AttrReverse
+		}
+		x = tuiPrint(x, 0, width, attr, bg, fmt.Sprintf(" %d %s ", i+1, l.name))
+		x = tuiPrint(x, 0, width, fg, bg, " ")
+	}
+
+	l := t.lists[t.pane]
+	y := 1
+	if t.pane == paneSearch {
+		x = tuiPrint(0, y, width, fg|termbox.AttrBold, bg, "/ ")
+		x = tuiPrint(x, y, width, fg, bg, string(t.query))
+		if t.editing {
+			termbox.SetCursor(x, y)
+		} else {
+			termbox.HideCursor()
+		}
+		y++
+	} else {
+		termbox.HideCursor()
+	}
+
+	// List, keeping the selected item visible
+	rows := height - y - 3
+	if rows > 0 {
+		if l.selected < l.top {
+			l.top = l.selected
+		} else if l.selected >= l.top+rows {
+			l.top = l.selected - rows + 1
+		}
+		tuiColumns(y, width, fg|termbox.AttrBold, bg, l.columns)
+		for i := l.top; i < len(l.items) && i < l.top+rows; i++ {
+			attr := fg
+			if i == l.selected {
+				attr |= termbox.AttrReverse
+			}
+			tuiColumns(y+1+i-l.top, width, attr, bg, l.items[i].columns)
+		}
+	}
+
+	// Now playing
+	current, playing := t.bridge.player.Current()
+	if current.Track == nil {
+		t.track = nil
+	}
+	status := "■"
+	if playing {
+		status = "▶"
+	} else if t.track != nil {
+		status = "‖"
+	}
+	line := status
+	if t.track != nil {
+		position := t.bridge.player.Position()
+		line += fmt.Sprintf(" %s - %s  %d:%02d / %s", trackArtists(t.track), t.track.Name,
+			position/time.Minute, position%time.Minute/time.Second, trackDuration(t.track))
+	}
+	volume := fmt.Sprintf("vol %d%% ", t.audio.Volume())
+	tuiPrint(0, height-2, width, fg|termbox.AttrBold, bg, line)
+	tuiPrint(width-runewidth.StringWidth(volume), height-2, width, fg, bg, volume)
+
+	if t.message != "" {
+		tuiPrint(0, height-1, width, fg, bg, t.message)
+	} else {
+		tuiPrint(0, height-1, width, termbox.ColorBlue, bg, tuiHelp)
+	}
+	termbox.Flush()
+}
+
+// tuiColumns prints the columns on the row, giving the first column most of
+// the space.
+func tuiColumns(y, width int, fg, bg termbox.Attribute, columns []string) {
+	if len(columns) == 0 {
+		return
+	}
+	share := width / (len(columns) + 1)
+	x := 0
+	for i, c := range columns {
+		w := share
+		switch {
+		case i == 0:
+			w = 2 * share
+		case i == len(columns)-1:
+			w = width - x
+		}
+		tuiPrint(x, y, x+w, fg, bg, strings.Repeat(" ", w))
+		tuiPrint(x, y, x+w, fg, bg, runewidth.Truncate(c, w-1, "…"))
+		x += w
+	}
+}
+
+// tuiPrint prints s at x, y, stopping before end, and returns the column after.
+func tuiPrint(x, y, end int, fg, bg termbox.Attribute, s string) int {
+	for _, r := range s {
+		w := runewidth.RuneWidth(r)
+		if x+w > end {
+			break
+		}
+		termbox.SetCell(x, y, r, fg, bg)
+		x += w
+	}
+	return x
+}
@@ -0,0 +1,311 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+var (
+	// webhookQueueSize is the number of events queued for each target before
+	// new events are dead-lettered.
+	webhookQueueSize = 128
+
+	// webhookTimeout is the timeout of a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+
+	// webhookMinBackoff and webhookMaxBackoff bounds the delay between retries.
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = time.Minute
+
+	// webhookMaxAttempts is the default number of delivery attempts.
+	webhookMaxAttempts = 5
+)
+
+// webhookConfig configures a single webhook target.
+type webhookConfig struct {
+	URL         string   `toml:"url"`
+	Events      []string `toml:"events"`
+	Secret      string   `toml:"secret"`
+	MaxAttempts int      `toml:"max_attempts"`
+
+	// LogLevel is the minimum level of log events to deliver, if the target
+	// subscribes to them. Defaults to warning.
+	LogLevel string `toml:"log_level"`
+}
+
+// WebhookPayload is the body posted to webhook targets.
+type WebhookPayload struct {
+	ID    uint64          `json:"id"`
+	Event string          `json:"event"`
+	Time  int64           `json:"time"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// webhookTarget delivers events to a single URL.
+type webhookTarget struct {
+	cfg    webhookConfig
+	filter eventFilter
+	client *http.Client
+	dead   *deadLetters
+
+	queue chan Event
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newWebhookTarget(cfg webhookConfig, client *http.Client, dead *deadLetters) *webhookTarget {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = webhookMaxAttempts
+	}
+	t := &webhookTarget{
+		cfg:    cfg,
+		filter: eventFilter{types: make(map[string]bool), level: logging.WARNING},
+		client: client,
+		dead:   dead,
+		queue:  make(chan Event, webhookQueueSize),
+		quit:   make(chan struct{}),
+	}
+	for _, event := range cfg.Events {
+		t.filter.types[event] = true
+	}
+	if cfg.LogLevel != "" {
+		if level, err := logging.LogLevel(cfg.LogLevel); err == nil {
+			t.filter.level = level
+		}
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+// Match reports if the target subscribes to the event. The state and log
+// events are only delivered when explicitly asked for.
+func (t *webhookTarget) Match(e Event) bool {
+	if (e.Type == "state" || e.Type == "log") && !t.filter.types[e.Type] {
+		return false
+	}
+	return t.filter.Match(e)
+}
+
+// Enqueue queues the event for delivery, or dead-letters it if the target is
+// too far behind.
+func (t *webhookTarget) Enqueue(e Event) {
+	select {
+	case t.queue <- e:
+	default:
+		t.dead.Add(t.cfg.URL, e, 0, "queue full")
+	}
+}
+
+func (t *webhookTarget) Close() {
+	close(t.quit)
+	t.wg.Wait()
+}
+
+func (t *webhookTarget) run() {
+	defer t.wg.Done()
+	for {
+		select {
+		case e := <-t.queue:
+			t.deliver(e)
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// deliver posts the event, retrying with an exponential backoff.
+func (t *webhookTarget) deliver(e Event) {
+	body, err := json.Marshal(&WebhookPayload{e.ID, e.Type, e.time.Unix(), e.Data})
+	if err != nil {
+		t.dead.Add(t.cfg.URL, e, 0, err.Error())
+		return
+	}
+
+	backoff := webhookMinBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := t.post(e, body)
+		if err == nil {
+			return
+		}
+		log.Warning("Webhook %s failed for event %d (attempt %d): %s", t.cfg.URL, e.ID, attempt, err)
+		if !retry || attempt >= t.cfg.MaxAttempts {
+			t.dead.Add(t.cfg.URL, e, attempt, err.Error())
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-t.quit:
+			t.dead.Add(t.cfg.URL, e, attempt, "shutting down")
+			return
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post makes a single delivery attempt and reports if a failure is worth
+// retrying.
+func (t *webhookTarget) post(e Event, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("User-Agent", prog)
+	req.Header.Set("X-Sith-Event", e.Type)
+	req.Header.Set("X-Sith-Delivery", strconv.FormatUint(e.ID, 10))
+	if t.cfg.Secret != "" {
+		req.Header.Set("X-Sith-Signature", "sha256="+webhookSignature(t.cfg.Secret, body))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return false, fmt.Errorf("unexpected status: %s", resp.Status)
+}
+
+// webhookSignature returns the hex encoded HMAC-SHA256 of the body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter is an event which could not be delivered.
+type deadLetter struct {
+	Time     int64           `json:"time"`
+	URL      string          `json:"url"`
+	ID       uint64          `json:"id"`
+	Event    string          `json:"event"`
+	Data     json.RawMessage `json:"data"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+}
+
+// deadLetters appends undeliverable events, one JSON object per line, to a
+// file for inspection.
+type deadLetters struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (d *deadLetters) Add(url string, e Event, attempts int, reason string) {
+	log.Error("Webhook %s gave up on event %d: %s", url, e.ID, reason)
+
+	line, err := json.Marshal(&deadLetter{time.Now().Unix(), url, e.ID, e.Type, e.Data, attempts, reason})
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(d.path), 0700); err != nil {
+		log.Error("Failed to create dead letter directory: %s", err)
+		return
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("Failed to open dead letter log: %s", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// webhooks delivers events sent through the events writer to the configured
+// webhook targets.
+type webhooks struct {
+	ew     *EventsWriter
+	client *http.Client
+	dead   *deadLetters
+
+	mu      sync.Mutex
+	targets []*webhookTarget
+}
+
+func newWebhooks(cfg *config, ew *EventsWriter) *webhooks {
+	w := &webhooks{
+		ew:     ew,
+		client: &http.Client{Timeout: webhookTimeout},
+		dead:   &deadLetters{path: cfg.DeadLetterPath()},
+	}
+	w.SetTargets(cfg.Webhooks)
+	go w.dispatch()
+	return w
+}
+
+// SetTargets replaces the webhook targets. Events queued for any previous
+// targets are dead-lettered.
+func (w *webhooks) SetTargets(cfgs []webhookConfig) {
+	var targets []*webhookTarget
+	for _, cfg := range cfgs {
+		targets = append(targets, newWebhookTarget(cfg, w.client, w.dead))
+	}
+
+	w.mu.Lock()
+	old := w.targets
+	w.targets = targets
+	w.mu.Unlock()
+
+	for _, t := range old {
+		t.Close()
+		for len(t.queue) > 0 {
+			w.dead.Add(t.cfg.URL, <-t.queue, 0, "target removed")
+		}
+	}
+}
+
+// dispatch distributes the events to the targets. If the subscription is
+// dropped for falling behind, it resubscribes to get the missed events.
+func (w *webhooks) dispatch() {
+	filter := eventFilter{types: map[string]bool{}, level: logging.DEBUG}
+	w.ew.follow(filter, false, w.enqueue)
+}
+
+func (w *webhooks) enqueue(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, t := range w.targets {
+		if t.Match(e) {
+			t.Enqueue(e)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// webhookRequest is a delivery received by the test server.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	time   time.Time
+}
+
+// newWebhookServer serves the statuses in order, repeating the last one, and
+// passes on every request received.
+func newWebhookServer(t *testing.T, statuses ...int) (*httptest.Server, chan webhookRequest) {
+	requests := make(chan webhookRequest, 16)
+	n := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{r.Header, body, time.Now()}
+		status := statuses[len(statuses)-1]
+		if n < len(statuses) {
+			status = statuses[n]
+		}
+		n++
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func newTestWebhookTarget(t *testing.T, cfg webhookConfig, server *httptest.Server) (*webhookTarget, string) {
+	minBackoff := webhookMinBackoff
+	webhookMinBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { webhookMinBackoff = minBackoff })
+
+	path := filepath.Join(t.TempDir(), "webhooks.dead.log")
+	cfg.URL = server.URL
+	target := newWebhookTarget(cfg, server.Client(), &deadLetters{path: path})
+	return target, path
+}
+
+func receive(t *testing.T, requests chan webhookRequest) webhookRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for delivery")
+	}
+	return webhookRequest{}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusNoContent)
+	target, path := newTestWebhookTarget(t, webhookConfig{Secret: "secret"}, server)
+
+	sent := time.Unix(1400000000, 0)
+	target.Enqueue(Event{ID: 7, Type: "track-end", Data: []byte(`{"version":1}`), time: sent})
+	r := receive(t, requests)
+	target.Close()
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != 7 || payload.Event != "track-end" || payload.Time != sent.Unix() || string(payload.Data) != `{"version":1}` {
+		t.Errorf("unexpected payload: %s", r.body)
+	}
+	if event := r.header.Get("X-Sith-Event"); event != "track-end" {
+		t.Errorf("event header: %s", event)
+	}
+	if id := r.header.Get("X-Sith-Delivery"); id != "7" {
+		t.Errorf("delivery header: %s", id)
+	}
+	signature := "sha256=" + webhookSignature("secret", r.body)
+	if got := r.header.Get("X-Sith-Signature"); got != signature {
+		t.Errorf("signature: %s != %s", got, signature)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no dead letters: %v", err)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	target, path := newTestWebhookTarget(t, webhookConfig{}, server)
+
+	sent := time.Now().Add(-time.Hour)
+	target.Enqueue(Event{ID: 1, Type: "track-end", time: sent})
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		r := receive(t, requests)
+		times = append(times, r.time)
+
+		// Retries carry the time the event was sent, not when retried.
+		var payload WebhookPayload
+		if err := json.Unmarshal(r.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Time != sent.Unix() {
+			t.Errorf("attempt %d: time %d != %d", i+1, payload.Time, sent.Unix())
+		}
+	}
+	target.Close()
+
+	if r := pending(requests); r != nil {
+		t.Errorf("unexpected delivery after success")
+	}
+	for i, backoff := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond} {
+		if d := times[i+1].Sub(times[i]); d < backoff {
+			t.Errorf("attempt %d: retried after %s, expected at least %s", i+2, d, backoff)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no dead letters: %v", err)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusInternalServerError)
+	target, path := newTestWebhookTarget(t, webhookConfig{MaxAttempts: 3}, server)
+
+	target.Enqueue(Event{ID: 3, Type: "play-track", Data: []byte(`{}`)})
+	for i := 0; i < 3; i++ {
+		receive(t, requests)
+	}
+	target.Close()
+	if r := pending(requests); r != nil {
+		t.Errorf("unexpected attempt after max attempts")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one dead letter: %q", data)
+	}
+	var dead deadLetter
+	if err := json.Unmarshal([]byte(lines[0]), &dead); err != nil {
+		t.Fatal(err)
+	}
+	if dead.ID != 3 || dead.Event != "play-track" || dead.Attempts != 3 || dead.URL != server.URL {
+		t.Errorf("unexpected dead letter: %s", lines[0])
+	}
+
+	// Client errors are not retried.
+	server, requests = newWebhookServer(t, http.StatusBadRequest)
+	target, path = newTestWebhookTarget(t, webhookConfig{}, server)
+	target.Enqueue(Event{ID: 4, Type: "play-track", Data: []byte(`{}`)})
+	receive(t, requests)
+	target.Close()
+	if r := pending(requests); r != nil {
+		t.Errorf("unexpected retry of client error")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected dead letter: %s", err)
+	}
+}
+
+// pending returns any request received, without waiting.
+func pending(requests chan webhookRequest) *webhookRequest {
+	select {
+	case r := <-requests:
+		return &r
+	default:
+		return nil
+	}
+}
+
+func TestWebhookMatch(t *testing.T) {
+	var tests = []struct {
+		cfg   webhookConfig
+		event Event
+		match bool
+	}{
+		{webhookConfig{}, Event{Type: "play-track"}, true},
+		{webhookConfig{}, Event{Type: "state"}, false},
+		{webhookConfig{}, Event{Type: "log", level: logging.CRITICAL}, false},
+		{webhookConfig{LogLevel: "debug"}, Event{Type: "log", level: logging.ERROR}, false},
+		{webhookConfig{Events: []string{"state"}}, Event{Type: "state"}, true},
+		{webhookConfig{Events: []string{"log"}}, Event{Type: "log", level: logging.WARNING}, true},
+		{webhookConfig{Events: []string{"log"}}, Event{Type: "log", level: logging.INFO}, false},
+		{webhookConfig{Events: []string{"log"}, LogLevel: "debug"}, Event{Type: "log", level: logging.DEBUG}, true},
+		{webhookConfig{Events: []string{"log"}}, Event{Type: "play-track"}, false},
+		{webhookConfig{Events: []string{"log"}, LogLevel: "error"}, Event{Type: "log", level: logging.ERROR}, true},
+		{webhookConfig{Events: []string{"log"}, LogLevel: "error"}, Event{Type: "log", level: logging.WARNING}, false},
+	}
+	for i, test := range tests {
+		target := newWebhookTarget(test.cfg, nil, nil)
+		if match := target.Match(test.event); match != test.match {
+			t.Errorf("%d: %v != %v", i, match, test.match)
+		}
+		target.Close()
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = wsPingInterval + 10*time.Second
+
+	// wsCommandQueue is the number of commands queued per connection while
+	// waiting for earlier ones.
+	wsCommandQueue = 32
+)
+
+// wsRequest is a command sent by the client. The id is passed back as is in the
+// response to correlate them.
+type wsRequest struct {
+	ID      string          `json:"id"`
+	Command string          `json:"command"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// wsMessage is sent to the client, either as a response to a command or as an
+// event.
+type wsMessage struct {
+	Type string `json:"type"`
+
+	// Set for responses.
+	ID     string      `json:"id,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *apiError   `json:"error,omitempty"`
+
+	// Set for events.
+	Event   string          `json:"event,omitempty"`
+	EventID uint64          `json:"event_id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type seekArgs struct {
+	Position float64 `form:"position" json:"position"`
+}
+
+type queueArgs struct {
+	URI string `form:"uri" json:"uri" binding:"required"`
+}
+
+type volumeArgs struct {
+	Volume *int `form:"volume" json:"volume"`
+}
+
+// wsHandler serves the combined event and control channel.
+type wsHandler struct {
+	bridge   *bridge
+	audio    *audioWriter
+	ew       *EventsWriter
+	upgrader websocket.Upgrader
+}
+
+func newWSHandler(bridge *bridge, audio *audioWriter, ew *EventsWriter) *wsHandler {
+	return &wsHandler{bridge: bridge, audio: audio, ew: ew}
+}
+
+// wsConn serializes writes to the underlying connection.
+type wsConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *wsConn) write(msg *wsMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *wsConn) ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// ServeHTTP upgrades the connection and starts delivering events. The same
+// types, log_level and lastEventId parameters as for the server sent events
+// are supported.
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, info *requestInfo) {
+	filter, err := newEventFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Info("Failed to upgrade websocket: %s", err)
+		return
+	}
+	defer conn.Close()
+	c := &wsConn{conn: conn}
+
+	s, missed := h.ew.subscribe(r.URL.Query().Get("lastEventId"), filter)
+	defer h.ew.unsubscribe(s)
+
+	done := make(chan struct{})
+	go h.readCommands(c, info.ID, done)
+
+	for _, e := range missed {
+		if err := c.write(eventMessage(e)); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				return
+			}
+			if err := c.write(eventMessage(e)); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := c.ping(); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func eventMessage(e Event) *wsMessage {
+	return &wsMessage{Type: "event", Event: e.Type, EventID: e.ID, Data: e.Data}
+}
+
+// readCommands reads commands until the connection is closed, and then
+// closes done to make the event loop exit. upgradeID is the id of the request
+// upgrading the connection.
+//
+// The commands are executed in order, one at a time. They might block while
+// the session is unavailable, which must not hold up reading, eg. the pongs.
+func (h *wsHandler) readCommands(c *wsConn, upgradeID string, done chan struct{}) {
+	defer close(done)
+	defer c.conn.Close()
+
+	commands := make(chan *wsRequest, wsCommandQueue)
+	defer close(commands)
+	go h.runCommands(c, commands, upgradeID)
+
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		return nil
+	})
+
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				c.write(&wsMessage{Type: "response", Error: newBadRequestError(err.Error())})
+				continue
+			}
+			return
+		}
+
+		select {
+		case commands <- &req:
+		default:
+			c.write(&wsMessage{Type: "response", ID: req.ID, Error: newUnavailableError("too many pending commands")})
+		}
+	}
+}
+
+// runCommands executes the commands in the order received.
+func (h *wsHandler) runCommands(c *wsConn, commands chan *wsRequest, upgradeID string) {
+	for req := range commands {
+		result, err := h.execute(req, wsRequestID(req, upgradeID))
+		c.write(&wsMessage{Type: "response", ID: req.ID, Result: result, Error: err})
+	}
+}
+
+// wsRequestID returns the id events caused by the command are traced to: the
+// command id when usable as a request id, or else the id of the upgrade.
+func wsRequestID(req *wsRequest, upgradeID string) string {
+	if validRequestID(req.ID) {
+		return req.ID
+	}
+	return upgradeID
+}
+
+// execute runs a single command. requestID is passed on with the resulting
+// events.
+func (h *wsHandler) execute(req *wsRequest, requestID string) (interface{}, *apiError) {
+	decode := func(v interface{}) *apiError {
+		if len(req.Params) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(req.Params, v); err != nil {
+			return newBadRequestError("invalid params: " + err.Error())
+		}
+		return nil
+	}
+
+	if err := h.bridge.sync(); err != nil {
+		return nil, err
+	}
+
+	switch req.Command {
+	case "play":
+		h.bridge.player.Resume(requestID)
+	case "pause":
+		h.bridge.player.Pause(requestID)
+	case "next":
+		h.bridge.player.Next(requestID)
+	case "load":
+		var args loadArgs
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		args.requestID = requestID
+		return nil, h.bridge.load(args)
+	case "queue":
+		var args queueArgs
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		if _, err := h.bridge.player.Queue(args.URI); err != nil {
+			return nil, newBadRequestError(err.Error())
+		}
+	case "seek":
+		var args seekArgs
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		h.bridge.player.Seek(time.Duration(args.Position * float64(time.Second)))
+	case "volume":
+		var args volumeArgs
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		if args.Volume != nil {
+			h.audio.SetVolume(*args.Volume)
+		}
+		return &VolumeResult{Volume: h.audio.Volume()}, nil
+	default:
+		return nil, newBadRequestError("unknown command: " + req.Command)
+	}
+	return nil, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2013-2014 Örjan Persson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sith
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestWSHandler(t *testing.T) *wsHandler {
+	ew := newTestEventsWriter(t, 8)
+	b := newTestBridge(true, true)
+	audio := &audioWriter{volume: 50, maxVolume: 80}
+	return newWSHandler(b, audio, ew)
+}
+
+func TestWSExecute(t *testing.T) {
+	var tests = []struct {
+		command string
+		params  string
+		result  string
+		code    string
+	}{
+		{"volume", ``, `{"volume":50}`, ""},
+		{"volume", `{"volume":20}`, `{"volume":20}`, ""},
+		{"volume", `{"volume":100}`, `{"volume":80}`, ""},
+		{"volume", `{"volume":"loud"}`, `null`, "request_error"},
+		{"load", `[1]`, `null`, "request_error"},
+		{"queue", `{"uri":1}`, `null`, "request_error"},
+		{"seek", `{"position":"end"}`, `null`, "request_error"},
+		{"stop", ``, `null`, "request_error"},
+	}
+	for _, test := range tests {
+		h := newTestWSHandler(t)
+		req := &wsRequest{ID: "1", Command: test.command, Params: json.RawMessage(test.params)}
+		result, err := h.execute(req, "1")
+		data, _ := json.Marshal(result)
+		if string(data) != test.result {
+			t.Errorf("%s %s: %s != %s", test.command, test.params, data, test.result)
+		}
+		code := ""
+		if err != nil {
+			code = err.Code
+		}
+		if code != test.code {
+			t.Errorf("%s %s: code %q != %q", test.command, test.params, code, test.code)
+		}
+	}
+
+	// Commands fail when the session does not become available in time.
+	h := newTestWSHandler(t)
+	h.bridge.running = false
+	h.bridge.SetSyncTimeout(10 * time.Millisecond)
+	if _, err := h.execute(&wsRequest{Command: "volume"}, ""); err == nil || err.Code != "unavailable" {
+		t.Errorf("expected unavailable: %v", err)
+	}
+}
+
+// dialWS connects to the handler and returns the connection and the server.
+func dialWS(t *testing.T, h *wsHandler) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r, &requestInfo{ID: "upgrade"})
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestWSConnection(t *testing.T) {
+	h := newTestWSHandler(t)
+	conn := dialWS(t, h)
+
+	// New clients are brought up to date with the state.
+	if msg := readWS(t, conn); !strings.HasPrefix(msg, `{"type":"event","event":"state","data":`) {
+		t.Errorf("expected state: %s", msg)
+	}
+
+	// Invalid commands are answered straight away, without an id.
+	conn.WriteMessage(websocket.TextMessage, []byte("nope"))
+	if msg := readWS(t, conn); !strings.HasPrefix(msg, `{"type":"response","error":{"code":"request_error"`) {
+		t.Errorf("expected error for invalid command: %s", msg)
+	}
+
+	// Commands are answered in the order sent, and run in that order.
+	for i, volume := range []int{10, 20, 30, 40, 50, 60} {
+		cmd := &wsRequest{ID: string(rune('a' + i)), Command: "volume"}
+		cmd.Params, _ = json.Marshal(map[string]int{"volume": volume})
+		if err := conn.WriteJSON(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []string{
+		`{"type":"response","id":"a","result":{"volume":10}}`,
+		`{"type":"response","id":"b","result":{"volume":20}}`,
+		`{"type":"response","id":"c","result":{"volume":30}}`,
+		`{"type":"response","id":"d","result":{"volume":40}}`,
+		`{"type":"response","id":"e","result":{"volume":50}}`,
+		`{"type":"response","id":"f","result":{"volume":60}}`,
+	}
+	for _, want := range tests {
+		if msg := readWS(t, conn); msg != want {
+			t.Errorf("%s != %s", msg, want)
+		}
+	}
+	if volume := h.audio.Volume(); volume != 60 {
+		t.Errorf("volume: %d", volume)
+	}
+
+	// Events are passed on as they are sent.
+	h.ew.SendEvent("track-end", &EmptyEvent{})
+	if msg := readWS(t, conn); !strings.HasPrefix(msg, `{"type":"event","event":"track-end","event_id":`) {
+		t.Errorf("expected track-end: %s", msg)
+	}
+}
+
+func TestWSClose(t *testing.T) {
+	h := newTestWSHandler(t)
+	conn := dialWS(t, h)
+	readWS(t, conn)
+	conn.Close()
+
+	// The subscriber is dropped once the client is gone, without waiting for
+	// an event or a ping.
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.ew.mu.Lock()
+		n := len(h.ew.subscribers)
+		h.ew.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber still kept after the client closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}